@@ -6,7 +6,11 @@ package cli
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ryanuber/columnize"
 	"github.com/tooda02/castle-cron/cron"
@@ -21,19 +25,49 @@ func RunCommand(args []string) error {
 	case "add":
 		return AddCommand(args)
 
+	case "config":
+		return ConfigCommand(args)
+
 	case "del":
 		return DelCommand(args)
 
+	case "deps":
+		return DepsCommand(args)
+
+	case "doctor":
+		return DoctorCommand(args)
+
 	case "help":
 		return HelpCommand(args)
 
+	case "history":
+		return HistoryCommand(args)
+
 	case "list":
 		return ListCommand(args)
 
+	case "migrate":
+		return MigrateCommand(args)
+
+	case "output":
+		return OutputCommand(args)
+
+	case "pause":
+		return PauseCommand(args)
+
+	case "resume":
+		return ResumeCommand(args)
+
+	case "run":
+		return RunNowCommand(args)
+
+	case "servers":
+		return ServersCommand(args)
+
 	case "upd":
 		return UpdCommand(args)
 	}
-	return fmt.Errorf("Unknown command \"%s\"; must be add, del, help, list, or upd", flag.Arg(0))
+	return fmt.Errorf("Unknown command \"%s\"; must be add, config, del, deps, doctor, help, history, list, migrate, output, pause, resume, run, servers, or upd", flag.Arg(0))
 }
 
 // Add a new job and store in Zookeeper
@@ -42,24 +76,104 @@ func AddCommand(args []string) (e error) {
 	if job, e = buildJobFromArgs(args); e == nil {
 		if e = job.WriteToZk(); e == nil {
 			printJobs([]*cron.Job{job})
+			warnUnplaceable(job)
 		}
 	}
 	return
 }
 
-// Update an existing job in Zookeeper
+// Warn if no running server can run a job, as it won't be scheduled until one starts
+func warnUnplaceable(job *cron.Job) {
+	if ok, err := job.Placeable(); err != nil {
+		log.Warning.Println(err.Error())
+	} else if !ok {
+		log.Warning.Printf("No running server matches the placement constraints of job %s; it won't run until one starts", job.Name)
+	}
+}
+
+// Update an existing job in Zookeeper.  A paused job stays paused, and round-robin placement carries on in turn.
 func UpdCommand(args []string) (e error) {
 	var job *cron.Job
 	if job, e = buildJobFromArgs(args); e == nil {
+		if jobs, err := cron.ListJobs(job.Name); err == nil && len(jobs) > 0 {
+			job.Paused = jobs[0].Paused
+			job.PlacedOn = jobs[0].PlacedOn
+		}
 		if e = job.UpdateZk(); e == nil {
 			printJobs([]*cron.Job{job})
+			warnUnplaceable(job)
 		}
 	}
 	return
 }
 
 func buildJobFromArgs(args []string) (job *cron.Job, e error) {
-	job = &cron.Job{}
+	var shellMode bool
+	var stdin, stdinFile, at string
+	var in time.Duration
+	job = &cron.Job{Env: map[string]string{}}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&shellMode, "sh", false, "Run cmd and args as a script with "+cron.DEFAULT_SHELL+" -c")
+	flags.StringVar(&job.Shell, "shell", "", "Run cmd and args as a script with this shell's -c option")
+	flags.StringVar(&stdin, "stdin", "", "Data for the job's standard input")
+	flags.StringVar(&stdinFile, "stdinfile", "", "File holding data for the job's standard input")
+	flags.Var(envFlag(job.Env), "env", "Environment variable NAME=value for the job; can be repeated")
+	flags.StringVar(&job.Dir, "dir", "", "Working directory of the job")
+	flags.StringVar(&job.User, "user", "", "Unix user to run the job as")
+	flags.StringVar(&job.Group, "group", "", "Unix group to run the job as (default user's primary group)")
+	flags.StringVar(&job.Concurrency, "concurrency", cron.CONCURRENCY_ALLOW, "Policy when a previous run is still active: allow, forbid, or replace")
+	flags.IntVar(&job.MaxRetries, "retries", 0, "Number of times to retry a failed run")
+	flags.DurationVar(&job.RetryDelay, "retrydelay", cron.DEFAULT_RETRY_DELAY, "Wait before the first retry; doubles with each further retry")
+	flags.DurationVar(&job.RetryMaxDelay, "retrymax", 0, "Maximum wait before a retry; 0 => no limit")
+	flags.StringVar(&job.Misfire, "misfire", cron.MISFIRE_ONCE, "Policy when the job is found past its misfire threshold: once, skip, or all")
+	flags.IntVar(&job.MisfireLimit, "misfirelimit", cron.DEFAULT_MISFIRE_LIMIT, "Maximum missed runs caught up by the all misfire policy")
+	flags.DurationVar(&job.MisfireThreshold, "misfirethreshold", cron.DEFAULT_MISFIRE_THRESHOLD, "Lateness beyond which a run counts as missed")
+	flags.StringVar(&job.Orphans, "orphans", cron.ORPHANS_FAIL, "Policy when the job's server stops while it's running: fail or rerun")
+	flags.StringVar(&job.TZ, "tz", "", "IANA time zone of the schedule, e.g. America/New_York (default server's local zone)")
+	flags.DurationVar(&job.Timeout, "timeout", 0, "Kill the job if it runs longer than this (e.g. 90s, 2h)")
+	flags.StringVar(&at, "at", "", "Run the job once at this time (RFC 3339, or YYYY-MM-DD HH:MM[:SS] in the job's zone) instead of on a schedule")
+	flags.DurationVar(&in, "in", 0, "Run the job once after this interval (e.g. 2h) instead of on a schedule")
+	flags.Var((*listFlag)(&job.AfterSuccess), "after", "Run the job after each successful run of this job; can be repeated")
+	flags.Var((*listFlag)(&job.AfterAny), "afterany", "Run the job after each run of this job, whether it succeeds or fails; can be repeated")
+	flags.Var((*listFlag)(&job.Servers), "server", "Name of a server that can run the job, which can contain wildcards * and ?; can be repeated")
+	flags.StringVar(&job.Selector, "selector", "", "Labels a server must have to run the job, e.g. zone=east,role!=db")
+	flags.StringVar(&job.Placement, "placement", "", "How the server that runs the job is chosen: random, round-robin, least-running, or race (default cluster default)")
+	flags.BoolVar(&job.Broadcast, "broadcast", false, "Run the job on every server that can run it rather than on one of them")
+	flags.DurationVar(&job.Deadline, "deadline", 0, "How long a broadcast run waits for every server to report; 0 => "+cron.DEFAULT_BROADCAST_DEADLINE.String())
+	flags.DurationVar(&job.Jitter, "jitter", 0, "Window within which runs are offset from the schedule; 0 => cluster default")
+	flags.StringVar(&job.JitterMode, "jittermode", "", "How runs are offset within the jitter window: hash, random, or none (default cluster default)")
+	flags.DurationVar(&job.Retain, "retain", 0, "Keep a one-shot job in the archive this long after its run; 0 => delete it")
+	if e = flags.Parse(args[1:]); e != nil {
+		return
+	}
+	args = append([]string{args[0]}, flags.Args()...)
+	if shellMode && job.Shell == "" {
+		job.Shell = cron.DEFAULT_SHELL
+	}
+	if stdinFile != "" {
+		if stdin != "" {
+			return nil, fmt.Errorf("Only one of -stdin and -stdinfile can be specified")
+		} else if job.Stdin, e = ioutil.ReadFile(stdinFile); e != nil {
+			return nil, fmt.Errorf("Unable to read standard input for job: %s", e.Error())
+		}
+	} else if stdin != "" {
+		job.Stdin = []byte(stdin)
+	}
+	if at != "" && in != 0 {
+		return nil, fmt.Errorf("Only one of -at and -in can be specified")
+	} else if in > 0 {
+		job.At = time.Now().Add(in)
+	} else if in < 0 {
+		return nil, fmt.Errorf("Invalid negative interval %v for -in", in)
+	} else if at != "" {
+		if job.At, e = parseAt(at, job.TZ); e != nil {
+			return nil, e
+		}
+	}
+	if job.OneShot() {
+		// A one-shot job has no schedule argument
+		args = append([]string{args[0], args[1], ""}, args[2:]...)
+	}
 	if len(args) < 4 {
 		e = fmt.Errorf("Not enough arguments for %s subcommand", args[0])
 	} else {
@@ -69,56 +183,608 @@ func buildJobFromArgs(args []string) (job *cron.Job, e error) {
 		if len(args) > 4 {
 			job.Args = args[4:]
 		}
-		_, e = job.SetNextRuntime()
+		if e = job.Validate(); e != nil {
+			return
+		} else if e = job.CheckDependencies(); e == nil {
+			_, e = job.SetNextRuntime()
+		}
 	}
 	return
 }
 
-// Delete a job from Zookeeper
-func DelCommand(args []string) (e error) {
-	if len(args) < 2 {
-		e = fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+// Parse the time of a one-shot job, which is RFC 3339 or a local time in the job's time zone
+func parseAt(at, tz string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return time.Time{}, fmt.Errorf("Invalid time zone \"%s\": %s", tz, err.Error())
+		}
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, at, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time \"%s\" for -at; must be RFC 3339 or YYYY-MM-DD HH:MM[:SS]", at)
+}
+
+// A flag that can be repeated to build a list of values
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// A flag that can be repeated to set environment variables NAME=value
+type envFlag map[string]string
+
+func (env envFlag) String() string {
+	vars := []string{}
+	for name, value := range env {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, " ")
+}
+
+func (env envFlag) Set(value string) error {
+	if i := strings.Index(value, "="); i < 1 {
+		return fmt.Errorf("Environment variable must be NAME=value")
 	} else {
-		job := cron.Job{Name: args[1]}
-		if e = job.DeleteFromZk(); e == nil {
-			log.Plain.Printf("Job %s deleted", job.Name)
+		env[value[:i]] = value[i+1:]
+	}
+	return nil
+}
+
+// Show the cluster configuration, first changing any settings specified
+func ConfigCommand(args []string) error {
+	config, err := cron.GetConfig()
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.DurationVar(&config.Jitter, "jitter", config.Jitter, "Default jitter window for jobs that don't set one")
+	flags.StringVar(&config.JitterMode, "jittermode", config.JitterMode, "Default jitter mode for jobs that don't set one: hash or random")
+	flags.StringVar(&config.Placement, "placement", config.Placement, "Default placement strategy for jobs that don't set one: random, round-robin, least-running, or race")
+	if err = flags.Parse(args[1:]); err != nil {
+		return err
+	} else if flags.NFlag() > 0 {
+		if err = config.Save(); err != nil {
+			return err
 		}
 	}
-	return
+	jitterMode := config.JitterMode
+	if jitterMode == "" {
+		jitterMode = cron.JITTER_HASH
+	}
+	placement := config.Placement
+	if placement == "" {
+		placement = cron.PLACEMENT_RANDOM
+	}
+	jobFormat := "gob (run migrate once every server is upgraded)"
+	if config.JobSchema > 0 {
+		jobFormat = fmt.Sprintf("JSON schema version %d", config.JobSchema)
+	}
+	output := []string{
+		"Setting | Value",
+		fmt.Sprintf("jitter | %v", config.Jitter),
+		"jittermode | " + jitterMode,
+		"placement | " + placement,
+		"jobformat | " + jobFormat,
+	}
+	log.Plain.Println(columnize.SimpleFormat(output))
+	return nil
 }
 
-// List a job or all jobs
-func ListCommand(args []string) error {
-	var name string
+// Delete a job from Zookeeper, unless other jobs depend on it
+func DelCommand(args []string) error {
+	var force bool
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&force, "f", false, "Delete the job even if other jobs depend on it")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	} else if flags.NArg() < 1 {
+		return fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+	}
+	job := cron.Job{Name: flags.Arg(0)}
+	dependents, err := job.Dependents()
+	if err != nil {
+		return err
+	} else if len(dependents) > 0 && !force {
+		return fmt.Errorf("Job(s) %s depend on job %s; remove the dependencies with upd first, or delete it anyway with del -f",
+			strings.Join(dependents, ", "), job.Name)
+	}
+	if err = job.DeleteFromZk(); err != nil {
+		return err
+	}
+	log.Plain.Printf("Job %s deleted", job.Name)
+	if len(dependents) > 0 {
+		log.Warning.Printf("Job(s) %s still depend on deleted job %s and won't be triggered by it", strings.Join(dependents, ", "), job.Name)
+	}
+	return nil
+}
+
+// Show the dependencies between jobs as trees of the jobs triggered by each job
+func DepsCommand(args []string) error {
+	jobs, err := cron.ListJobs("")
+	if err != nil {
+		return err
+	}
+	dependents := map[string][]*cron.Job{}
+	roots := []string{}
+	exists := map[string]bool{}
+	for _, job := range jobs {
+		exists[job.Name] = true
+		upstream := job.DependsOn()
+		for _, name := range upstream {
+			dependents[name] = append(dependents[name], job)
+		}
+		if len(upstream) == 0 {
+			roots = append(roots, job.Name)
+		}
+	}
+	missing := []string{} // Jobs depended on that have been deleted
+	for name := range dependents {
+		if !exists[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
 	if len(args) > 1 {
-		name = args[1]
+		jobs, err = cron.ListJobs(args[1])
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if upstream := job.DependsOn(); len(upstream) > 0 {
+				log.Plain.Printf("%s runs after %s", job.Name, strings.Join(upstream, ", "))
+			}
+			for _, name := range job.DependsOn() {
+				if !exists[name] {
+					log.Plain.Printf("%s depends on job %s, which doesn't exist", job.Name, name)
+				}
+			}
+			log.Plain.Printf("%s", job.Name)
+			printDependents(dependents, job.Name, "")
+		}
+		return nil
+	}
+	found := false
+	for _, name := range roots {
+		if len(dependents[name]) > 0 {
+			log.Plain.Printf("%s", name)
+			printDependents(dependents, name, "")
+			found = true
+		}
 	}
-	if jobs, err := cron.ListJobs(name); err != nil {
+	for _, name := range missing {
+		log.Plain.Printf("%s (doesn't exist; its dependents are never triggered)", name)
+		printDependents(dependents, name, "")
+		found = true
+	}
+	if !found {
+		log.Plain.Printf("No job dependencies found")
+	}
+	return nil
+}
+
+// Print the tree of jobs a job's runs trigger
+func printDependents(dependents map[string][]*cron.Job, name, indent string) {
+	for _, job := range dependents[name] {
+		condition := "after success"
+		for _, upstream := range job.AfterAny {
+			if upstream == name {
+				condition = "after any result"
+			}
+		}
+		log.Plain.Printf("%s  -> %s (%s)", indent, job.Name, condition)
+		printDependents(dependents, job.Name, indent+"     ")
+	}
+}
+
+// Pause a job, or all jobs matching a mask, so they don't run until resumed
+func PauseCommand(args []string) error {
+	return changeJobs(args, "paused", (*cron.Job).Pause)
+}
+
+// Resume a paused job, or all jobs matching a mask, scheduling them from now
+func ResumeCommand(args []string) error {
+	return changeJobs(args, "resumed", (*cron.Job).Resume)
+}
+
+// Apply a change to the jobs named by a pause or resume command
+func changeJobs(args []string, done string, change func(*cron.Job) error) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+	} else if jobs, err := cron.ListJobs(args[1]); err != nil {
 		return err
 	} else if len(jobs) == 0 {
-		fmt.Printf("No jobs found\n")
+		return fmt.Errorf("No jobs found matching %s", args[1])
 	} else {
+		for _, job := range jobs {
+			if err = change(job); err != nil {
+				return err
+			}
+			log.Plain.Printf("Job %s %s", job.Name, done)
+		}
 		printJobs(jobs)
 	}
 	return nil
 }
 
+// Queue an immediate ad-hoc run of a job, optionally waiting for it to complete
+func RunNowCommand(args []string) error {
+	var wait bool
+	var timeout time.Duration
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&wait, "w", false, "Wait for the run to complete and show its result")
+	flags.DurationVar(&timeout, "wt", 0, "Maximum time to wait with -w; 0 => no limit")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = append([]string{args[0]}, flags.Args()...)
+	if len(args) < 2 {
+		return fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+	}
+	jobs, err := cron.ListJobs(args[1])
+	if err != nil {
+		return err
+	} else if len(jobs) != 1 {
+		return fmt.Errorf("%s subcommand must name exactly one job", args[0])
+	}
+	job := jobs[0]
+	runID, err := job.RunNow()
+	if err != nil {
+		return err
+	}
+	log.Plain.Printf("Run %s of job %s queued", runID, job.Name)
+	if wait {
+		if record, err := cron.WaitForRun(job.Name, runID, timeout); err != nil {
+			return err
+		} else {
+			printHistory([]*cron.RunRecord{record})
+			if outputs, err := cron.ListOutput(job.Name, 0); err != nil {
+				return err
+			} else {
+				for _, output := range outputs {
+					if output.RunID == runID {
+						log.Plain.Printf("%s", output.Output)
+						if output.Truncated {
+							log.Plain.Printf("=== Output truncated")
+						}
+					}
+				}
+			}
+			if record.Err != "" {
+				return fmt.Errorf("Run %s of job %s failed: %s", runID, job.Name, record.Err)
+			}
+		}
+	}
+	return nil
+}
+
+// Switch the cluster to writing jobs as JSON and rewrite jobs stored in the legacy gob encoding
+func MigrateCommand(args []string) error {
+	if migrated, err := cron.MigrateJobs(); err != nil {
+		return err
+	} else {
+		log.Plain.Printf("Migrated %d job znode(s) to JSON schema version %d; jobs are now written as JSON", migrated, cron.JOB_SCHEMA_VERSION)
+	}
+	return nil
+}
+
+// List a job or all jobs, optionally including archived one-shot jobs
+func ListCommand(args []string) error {
+	var name string
+	var archived bool
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&archived, "a", false, "Include archived one-shot jobs")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		name = flags.Arg(0)
+	}
+	jobs, err := cron.ListJobs(name)
+	quarantined, qerr := cron.ListQuarantine(name)
+	if qerr != nil {
+		return qerr
+	} else if err != nil && !(archived && name != "") && len(quarantined) == 0 {
+		return err // A named job can be missing from the job list if it's archived or quarantined
+	}
+	if archived {
+		if archive, err := cron.ListArchive(name); err != nil {
+			return err
+		} else {
+			jobs = append(jobs, archive...)
+		}
+	}
+	if len(jobs) == 0 && len(quarantined) == 0 {
+		fmt.Printf("No jobs found\n")
+	} else if len(jobs) > 0 {
+		printJobs(jobs)
+	}
+	if len(quarantined) > 0 {
+		log.Plain.Printf("%d undecodable job znode(s) quarantined; see castle-cron doctor", len(quarantined))
+		printQuarantine(quarantined)
+	}
+	return nil
+}
+
+// Check every job can be decoded, quarantining any that can't, and report the quarantined znodes
+func DoctorCommand(args []string) error {
+	var clear bool
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.BoolVar(&clear, "clear", false, "Delete the quarantined znodes after reporting them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	legacy, err := cron.CheckJobs()
+	if err != nil {
+		return err
+	}
+	quarantined, err := cron.ListQuarantine("")
+	if err != nil {
+		return err
+	}
+	if legacy > 0 {
+		log.Plain.Printf("%d job znode(s) still in the legacy gob encoding; run castle-cron migrate", legacy)
+	}
+	if len(quarantined) == 0 {
+		log.Plain.Printf("No quarantined jobs found")
+		return nil
+	}
+	printQuarantine(quarantined)
+	if !clear {
+		return fmt.Errorf("%d job znode(s) quarantined in %s; re-add the jobs, then clear them with doctor -clear",
+			len(quarantined), cron.PATH_QUARANTINE)
+	}
+	for _, q := range quarantined {
+		if err = q.Clear(); err != nil {
+			return err
+		}
+	}
+	log.Plain.Printf("Cleared %d quarantined job znode(s)", len(quarantined))
+	return nil
+}
+
+// List the running servers and their labels
+func ServersCommand(args []string) error {
+	if servers, err := cron.ListServers(); err != nil {
+		return err
+	} else if len(servers) == 0 {
+		fmt.Printf("No servers running\n")
+	} else {
+		output := []string{
+			"Server | Started | Running | Labels",
+		}
+		for _, info := range servers {
+			output = append(output, info.Name+" | "+strconv.FormatBool(info.Started)+" | "+strconv.Itoa(info.Running)+" | "+cron.FormatLabels(info.Labels))
+		}
+		log.Plain.Println(columnize.SimpleFormat(output))
+	}
+	return nil
+}
+
+// Show the run history of a job
+func HistoryCommand(args []string) error {
+	runs := 0
+	if len(args) < 2 {
+		return fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+	} else if len(args) > 2 {
+		var err error
+		if runs, err = strconv.Atoi(args[2]); err != nil || runs < 1 {
+			return fmt.Errorf("Invalid number of runs \"%s\" for %s subcommand", args[2], args[0])
+		}
+	}
+	if records, err := cron.ListHistory(args[1], runs); err != nil {
+		return err
+	} else if len(records) == 0 {
+		fmt.Printf("No run history found for job %s\n", args[1])
+	} else {
+		printHistory(records)
+	}
+	return nil
+}
+
+// Show the saved output of a job's most recent runs
+func OutputCommand(args []string) error {
+	runs := 1
+	if len(args) < 2 {
+		return fmt.Errorf("Job name not supplied for %s subcommand", args[0])
+	} else if len(args) > 2 {
+		var err error
+		if runs, err = strconv.Atoi(args[2]); err != nil || runs < 1 {
+			return fmt.Errorf("Invalid number of runs \"%s\" for %s subcommand", args[2], args[0])
+		}
+	}
+	if outputs, err := cron.ListOutput(args[1], runs); err != nil {
+		return err
+	} else if len(outputs) == 0 {
+		fmt.Printf("No saved output found for job %s\n", args[1])
+	} else {
+		for _, output := range outputs {
+			status := "OK"
+			if output.Err != "" {
+				status = output.Err
+			}
+			log.Plain.Printf("=== Run %s on %s at %s (%v seconds): %s",
+				output.RunID, output.Server, output.Start.Format("2006-01-02 15:04:05"),
+				output.End.Sub(output.Start).Seconds(), status)
+			log.Plain.Printf("%s", output.Output)
+			if output.Truncated {
+				log.Plain.Printf("=== Output truncated")
+			}
+		}
+	}
+	return nil
+}
+
+// Print a formatted list of runs
+func printHistory(records []*cron.RunRecord) {
+	output := []string{
+		"Start | End | Seconds | Server | Attempt | Exit | Error",
+	}
+	for _, record := range records {
+		attempt := strconv.Itoa(record.Attempt)
+		if record.After != "" {
+			attempt = "after " + record.After
+		} else if record.AdHoc {
+			attempt = "run"
+		}
+		output = append(output,
+			record.Start.Format("2006-01-02 15:04:05")+" | "+
+				record.End.Format("2006-01-02 15:04:05")+" | "+
+				fmt.Sprintf("%.3f", record.Seconds())+" | "+
+				record.Server+" | "+
+				attempt+" | "+
+				strconv.Itoa(record.ExitCode)+" | "+
+				record.Err)
+	}
+	result := columnize.SimpleFormat(output)
+	log.Plain.Println(result)
+}
+
+// Print a formatted list of quarantined znodes
+func printQuarantine(quarantined []*cron.QuarantinedJob) {
+	output := []string{
+		"Znode | Quarantined | Error",
+	}
+	for _, q := range quarantined {
+		output = append(output, q.Path+" | "+q.Time.Format("2006-01-02 15:04:05")+" | "+q.Err)
+	}
+	result := columnize.SimpleFormat(output)
+	log.Plain.Println(result)
+}
+
 // Print a formatted list of jobs
 func printJobs(jobs []*cron.Job) {
 	output := []string{
-		"Name | Next Runtime | Error | Command",
+		"Name | Next Runtime | Status | Options | Command",
+	}
+	servers, err := cron.ListServers()
+	if err != nil {
+		log.Warning.Println(err.Error())
 	}
 	for _, job := range jobs {
-		errFlag := ""
+		status := ""
+		nextRuntime := job.FmtNextRuntime()
 		if job.HasError {
-			errFlag = "Err"
+			status = "Err"
+		} else if job.Paused {
+			status = "Paused"
+		} else if !job.Retired.IsZero() {
+			status = "Archived"
+		} else if job.OneShot() && job.NextRuntime.IsZero() {
+			status = "Done"
+		} else if !job.BroadcastTick.IsZero() {
+			status = "Broadcasting"
+		} else if err == nil && !job.PlaceableAmong(servers) {
+			status = "Unplaceable"
+		}
+		if job.NextRuntime.IsZero() {
+			nextRuntime = "-"
 		}
 		output = append(output,
 			job.Name+" | "+
-				job.FmtNextRuntime()+" | "+
-				errFlag+" | "+
+				nextRuntime+" | "+
+				status+" | "+
+				jobOptions(job)+" | "+
 				job.Cmd+" "+strings.Join(job.Args, " "))
 	}
 	result := columnize.SimpleFormat(output)
-	log.Plain.Printf(result)
+	log.Plain.Println(result)
+}
+
+// Summarize a job's optional settings for printJobs
+func jobOptions(job *cron.Job) string {
+	options := []string{}
+	if job.Concurrency != "" && job.Concurrency != cron.CONCURRENCY_ALLOW {
+		options = append(options, "concurrency="+job.Concurrency)
+	}
+	if job.Misfire != "" && job.Misfire != cron.MISFIRE_ONCE {
+		options = append(options, "misfire="+job.Misfire)
+	}
+	if job.CatchUp > 0 {
+		options = append(options, fmt.Sprintf("catchup=%d", job.CatchUp))
+	}
+	if strings.ToLower(job.Orphans) == cron.ORPHANS_RERUN {
+		options = append(options, "orphans="+job.Orphans)
+	}
+	if job.MaxRetries > 0 {
+		options = append(options, fmt.Sprintf("retries=%d", job.MaxRetries))
+	}
+	if job.Attempt > 0 {
+		options = append(options, fmt.Sprintf("attempt=%d/%d", job.Attempt, job.MaxRetries))
+	}
+	if job.Shell != "" {
+		options = append(options, "shell="+job.Shell)
+	}
+	if len(job.Stdin) > 0 {
+		options = append(options, fmt.Sprintf("stdin=%dbytes", len(job.Stdin)))
+	}
+	if len(job.Env) > 0 {
+		options = append(options, "env="+envFlag(job.Env).String())
+	}
+	if job.Dir != "" {
+		options = append(options, "dir="+job.Dir)
+	}
+	if job.User != "" {
+		options = append(options, "user="+job.User)
+	}
+	if job.Group != "" {
+		options = append(options, "group="+job.Group)
+	}
+	if job.TZ != "" {
+		options = append(options, "tz="+job.TZ)
+	}
+	if job.Timeout > 0 {
+		options = append(options, fmt.Sprintf("timeout=%v", job.Timeout))
+	}
+	if job.OneShot() {
+		options = append(options, "at="+job.At.Format(time.RFC3339))
+	}
+	if len(job.AfterSuccess) > 0 {
+		options = append(options, "after="+strings.Join(job.AfterSuccess, "+"))
+	}
+	if len(job.AfterAny) > 0 {
+		options = append(options, "afterany="+strings.Join(job.AfterAny, "+"))
+	}
+	if job.Selector != "" {
+		options = append(options, "selector="+job.Selector)
+	}
+	if len(job.Servers) > 0 {
+		options = append(options, "servers="+strings.Join(job.Servers, "+"))
+	}
+	if job.Placement != "" {
+		options = append(options, "placement="+job.Placement)
+	}
+	if job.Broadcast {
+		options = append(options, "broadcast")
+	}
+	if job.Deadline > 0 {
+		options = append(options, fmt.Sprintf("deadline=%v", job.Deadline))
+	}
+	if job.Jitter > 0 {
+		options = append(options, fmt.Sprintf("jitter=%v", job.Jitter))
+	}
+	if job.JitterMode != "" {
+		options = append(options, "jittermode="+job.JitterMode)
+	}
+	if job.Attempt == 0 && !job.BaseRuntime.IsZero() && job.NextRuntime.After(job.BaseRuntime) {
+		options = append(options, fmt.Sprintf("offset=+%v", job.NextRuntime.Sub(job.BaseRuntime)))
+	}
+	if job.Retain > 0 {
+		options = append(options, fmt.Sprintf("retain=%v", job.Retain))
+	}
+	return strings.Join(options, ",")
 }
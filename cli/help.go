@@ -4,10 +4,60 @@ import (
 	"fmt"
 )
 
+// Options of the add and upd subcommands
+const jobOptionsHelp = "Options:\n" +
+	"  -after job\t\tRun the job after each successful run of this job; can be repeated\n" +
+	"  -afterany job\t\tRun the job after each run of this job, whether it succeeds or fails; can be repeated\n" +
+	"  -broadcast\t\tRun the job on every server that can run it, once each time it's due, rather than on one\n" +
+	"  -deadline duration\tHow long a broadcast run waits for every server to report before the job is\n" +
+	"\t\t\trescheduled (default 10m)\n" +
+	"  -at time\t\tRun the job once at this time instead of on a schedule; omit the sched argument.\n" +
+	"\t\t\tThe time is RFC 3339 or YYYY-MM-DD HH:MM[:SS] in the -tz zone (default local zone)\n" +
+	"  -in duration\t\tRun the job once after this interval (e.g. 2h) instead of on a schedule\n" +
+	"  -retain duration\tKeep a one-shot job in the archive this long after its run (default 0 deletes it with its output and history)\n" +
+	"  -dir path\t\tWorking directory of the job\n" +
+	"  -env NAME=value\tEnvironment variable for the job; can be repeated\n" +
+	"  -group group\t\tUnix group to run the job as (default user's primary group)\n" +
+	"  -server name\t\tRun only on this server; can contain wildcards * and ? and be repeated\n" +
+	"  -selector reqs\tRun only on servers whose -l labels meet all of a comma-separated list of\n" +
+	"\t\t\trequirements name=value, name!=value, name, or !name, e.g. zone=east,role!=db\n" +
+	"  -placement strategy\tHow the server that runs the job is chosen among those it can run on: random,\n" +
+	"\t\t\tround-robin, least-running, or race (default the cluster's placement; see help config)\n" +
+	"  -sh\t\t\tRun cmd and args, joined by blanks, as a script with /bin/sh -c\n" +
+	"  -shell path\t\tRun cmd and args, joined by blanks, as a script with this shell's -c option\n" +
+	"  -stdin data\t\tData for the job's standard input\n" +
+	"  -stdinfile path\tFile whose contents are stored with the job as its standard input\n" +
+	"  -user user\t\tUnix user to run the job as; the server must be able to switch to it\n" +
+	"  -concurrency policy\tWhen a previous run is still active anywhere in the cluster: allow (default) starts\n" +
+	"\t\t\tanother run, forbid skips this run, replace kills the active run and starts a new one\n" +
+	"  -jitter duration\tOffset runs by up to this much so jobs scheduled together aren't all due at once\n" +
+	"\t\t\t(default the cluster's jitter; see help config)\n" +
+	"  -jittermode mode\tHow runs are offset: hash (a fixed offset from the job's name), random (a new offset\n" +
+	"\t\t\teach run), or none (default the cluster's jitter mode)\n" +
+	"  -misfire policy\tWhen the job is found past its misfire threshold, e.g. after the cluster was down:\n" +
+	"\t\t\tonce (default) runs it once, skip drops the late run, all runs every missed occurrence\n" +
+	"  -misfirelimit n\tMaximum missed runs made by the all misfire policy (default 10)\n" +
+	"  -misfirethreshold duration\tLateness beyond which a run counts as missed (default 1m)\n" +
+	"  -orphans policy\tWhen the server running the job stops before it completes: fail (default) records\n" +
+	"\t\t\tthe run as failed, rerun also runs the job again on another server\n" +
+	"  -retries n\t\tRetry a failed run up to n times, preferably on another server\n" +
+	"  -retrydelay duration\tWait before the first retry (default 1m); doubles with each further retry\n" +
+	"  -retrymax duration\tMaximum wait before a retry (default no limit)\n" +
+	"  -timeout duration\tKill the job's process group if it runs longer than this (e.g. 90s, 2h)\n" +
+	"  -tz zone\t\tIANA time zone of the schedule, e.g. America/New_York (default server's local zone)\n"
+
+// Environment variables set for every run
+const jobEnvHelp = "Every run also has these environment variables:\n" +
+	"  CASTLE_CRON_JOB\t\tName of the job\n" +
+	"  CASTLE_CRON_SERVER\t\tName of the server running the job\n" +
+	"  CASTLE_CRON_SCHEDULED_TIME\tTime the run was scheduled for (RFC 3339)\n" +
+	"  CASTLE_CRON_RUN_ID\t\tUnique id of the run\n"
+
 func HelpCommand(args []string) error {
 	switch args[1] {
 	case "add":
-		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] add name \"sched\" cmd [args...]\n\n" +
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] add [options] name \"sched\" cmd [args...]\n" +
+			"castle-cron [-d] [-zk server:port] [-zt timeout] add -at time|-in duration [options] name cmd [args...]\n\n" +
 			"Add a new job to the schedule\n" +
 			"  -d\tProvide TRACE logging\n" +
 			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
@@ -15,24 +65,115 @@ func HelpCommand(args []string) error {
 			"  name\tName of job; must be unique\n" +
 			"  sched\tcron-like blank-separated schedule string; see help sched for details\n" +
 			"  cmd\tCommand to run\n" +
-			"  args\tCommand arguments\n")
+			"  args\tCommand arguments\n" +
+			jobOptionsHelp +
+			jobEnvHelp)
+
+	case "config":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] config [options]\n\n" +
+			"Show the cluster-wide settings, first changing any specified as options\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"Options:\n" +
+			"  -jitter duration\tDefault jitter window for jobs that don't set one (default 0, no jitter).\n" +
+			"\t\t\tChanges apply to each job the next time it's scheduled.\n" +
+			"  -jittermode mode\tDefault jitter mode for jobs that don't set one: hash (default) or random\n" +
+			"  -placement strategy\tDefault placement strategy for jobs that don't set one: random (default) picks a\n" +
+			"\t\t\tserver at random for each run, round-robin picks each server in turn, least-running picks\n" +
+			"\t\t\tthe server running the fewest jobs, race lets the first server to get the lock run it\n")
 
 	case "del":
-		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] del name\n\n" +
-			"Delete a job from the schedule\n" +
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] del [-f] name\n\n" +
+			"Delete a job from the schedule.  A job that other jobs depend on isn't deleted unless forced.\n" +
 			"  -d\tProvide TRACE logging\n" +
 			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
 			"  -zt\tZookeeper session timeout\n" +
+			"  -f\tDelete the job even if other jobs depend on it; they're no longer triggered\n" +
 			"  name\tName of job; must already exist\n")
 
+	case "deps":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] deps [name]\n\n" +
+			"Show the jobs triggered by each job's runs, as set by the -after and -afterany options of add and upd\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  name\tName of job whose dependencies to show; can contain \"*\" as a wildcard match.\n" +
+			"\tIf omitted, show the trees of dependent jobs starting from each job that depends on no other.\n")
+
+	case "doctor":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] doctor [-clear]\n\n" +
+			"Check that every job in /jobs, /nextjob, /adhoc, and /archive can be decoded, quarantining any that\n" +
+			"can't, and list the quarantined znodes with the error found.  Servers skip quarantined jobs, so re-add\n" +
+			"them to run them again.  Exits with an error while any are quarantined.\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  -clear\tDelete the quarantined znodes after listing them\n")
+
+	case "history":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] history name [runs]\n\n" +
+			"Show when a job ran, on which server, how long it took, and its exit status, most recent first\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  name\tName of job\n" +
+			"  runs\tNumber of runs to show (default all runs kept)\n")
+
 	case "list":
-		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] list [name]\n\n" +
-			"Delete a job from the schedule\n" +
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] list [-a] [name]\n\n" +
+			"List jobs in the schedule, warning of any that can't be decoded, and any of their znodes already\n" +
+			"quarantined (see doctor)\n" +
 			"  -d\tProvide TRACE logging\n" +
 			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
 			"  -zt\tZookeeper session timeout\n" +
+			"  -a\tAlso list archived one-shot jobs\n" +
 			"  name\tName of job to list; can be omitted to list all jobs or contain \"*\" as a wildcard match\n")
 
+	case "migrate":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] migrate\n\n" +
+			"Switch the cluster to writing jobs as versioned JSON, and rewrite the jobs in /jobs, /nextjob, /adhoc,\n" +
+			"and /archive that are still in the gob encoding used by earlier releases.  Until then jobs are written\n" +
+			"gob-encoded.  Upgrade every server first, as earlier releases can't read JSON.\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n")
+
+	case "output":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] output name [runs]\n\n" +
+			"Show the saved stdout and stderr of a job's most recent runs, most recent first\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  name\tName of job\n" +
+			"  runs\tNumber of runs to show (default 1)\n")
+
+	case "pause":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] pause name\n\n" +
+			"Pause a job so it doesn't run until resumed; its definition, output, and history are kept\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  name\tName of job; can contain \"*\" as a wildcard match to pause several jobs\n")
+
+	case "resume":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] resume name\n\n" +
+			"Resume a paused job, scheduling its next run after the current time\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  name\tName of job; can contain \"*\" as a wildcard match to resume several jobs\n")
+
+	case "run":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] run [-w] [-wt timeout] name\n\n" +
+			"Run a job now on one of the servers, without changing its schedule\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n" +
+			"  -w\tWait for the run to complete and show its history and output\n" +
+			"  -wt\tMaximum time to wait with -w, e.g. 10m (default no limit)\n" +
+			"  name\tName of job; must already exist.  Paused jobs can be run.\n")
+
 	case "sched":
 		fmt.Printf("Job schedule; must be a quoted string containing 5 - 7 blank-separated values.\n\n" +
 			"  Field name\tMandatory?\tAllowed values\tAllowed special characters\n" +
@@ -43,20 +184,45 @@ func HelpCommand(args []string) error {
 			"  Day of month\tYes\t\t1-31\t\t* / , - L W\n" +
 			"  Month\t\tYes\t\t1-12 or JAN-DEC\t* / , -\n" +
 			"  Day of week\tYes\t\t0-6 or SUN-SAT\t* / , - L #\n" +
-			"  Year\t\tNo\t\t1970–2099\t* / , -\n")
+			"  Year\t\tNo\t\t1970–2099\t* / , -\n\n" +
+			"The schedule can be prefixed with CRON_TZ=zone to run it in an IANA time zone, e.g.\n" +
+			"\"CRON_TZ=America/New_York 0 9 * * *\"; this is equivalent to the -tz option of add and upd.\n" +
+			"Without a zone, the schedule follows the local zone of the server that calculates the next runtime.\n" +
+			"Times skipped when clocks spring forward run the same time after the change (02:30 runs at 03:30);\n" +
+			"times repeated when clocks fall back run once, at their first occurrence.\n\n" +
+			"The schedule can instead be one of:\n" +
+			"  @every duration\tRun at a fixed interval of at least 1s, e.g. \"@every 90s\" or \"@every 7m\".  Runs are\n" +
+			"\t\t\tmultiples of the interval after the job was added or updated, so they don't drift.\n" +
+			"  @yearly, @annually\tRun at midnight on January 1 (0 0 1 1 *)\n" +
+			"  @monthly\t\tRun at midnight on the first of the month (0 0 1 * *)\n" +
+			"  @weekly\t\tRun at midnight on Sunday (0 0 * * 0)\n" +
+			"  @daily, @midnight\tRun at midnight (0 0 * * *)\n" +
+			"  @hourly\t\tRun at the start of every hour (0 * * * *)\n" +
+			"  @reboot\t\tRun when the cluster starts, i.e. when a server starts while no other server is running\n" +
+			"  -\t\t\tNo schedule; run only when triggered by a dependency (-after, -afterany) or the run command\n")
+
+	case "servers":
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] servers\n\n" +
+			"List the running servers, whether they have finished starting, the number of jobs they're running,\n" +
+			"and the labels set by their -l flag\n" +
+			"  -d\tProvide TRACE logging\n" +
+			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
+			"  -zt\tZookeeper session timeout\n")
 
 	case "upd":
-		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] upd name \"sched\" cmd [args...]\n\n" +
+		fmt.Printf("castle-cron [-d] [-zk server:port] [-zt timeout] upd [options] name \"sched\" cmd [args...]\n\n" +
 			"Update a job in the schedule\n" +
 			"  -d\tProvide TRACE logging\n" +
 			"  -zk\tComma-separated list of Zookeeper server(s) in form host:port (defaults to ZOOKEEPER_SERVERS)\n" +
 			"  -zt\tZookeeper session timeout\n" +
-			"  name\tName of job; must already exist\n" +
+			"  name\tName of job; must already exist.  A paused job stays paused.\n" +
 			"  sched\tcron-like blank-separated schedule string; see help sched for details\n" +
 			"  cmd\tCommand to run\n" +
-			"  args\tCommand arguments\n")
+			"  args\tCommand arguments\n" +
+			jobOptionsHelp +
+			jobEnvHelp)
 	default:
-		return fmt.Errorf("Unknown command \"%s\"; must be add, del, list, sched, or upd", args[1])
+		return fmt.Errorf("Unknown command \"%s\"; must be add, config, del, deps, doctor, history, list, migrate, output, pause, resume, run, sched, servers, or upd", args[1])
 	}
 	return nil
 }
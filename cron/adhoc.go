@@ -0,0 +1,106 @@
+package cron
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+/*
+Queue an immediate ad-hoc run of a job and return its run id.  The run is a
+copy of the job stored in /adhoc/<jobname>/<runid> with its next runtime set
+to now, so it's scheduled through /nextjob like any other run and exactly one
+server runs it.  The job itself, including its next runtime, isn't changed.
+*/
+func (job *Job) RunNow() (runID string, e error) {
+	return job.queueAdhoc("")
+}
+
+// Queue an ad-hoc run of a job triggered by the end of a run of a job it depends on
+func (job *Job) runAfter(upstream string) (runID string, e error) {
+	return job.queueAdhoc(upstream)
+}
+
+// Queue an ad-hoc run of a job, recording the job that triggered it, if any
+func (job *Job) queueAdhoc(triggeredBy string) (runID string, e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	adhoc := *job
+	adhoc.NextRuntime = time.Now()
+	adhoc.AdHoc = newRunID(adhoc.NextRuntime)
+	adhoc.TriggeredBy = triggeredBy
+	adhoc.Paused = false
+	adhoc.HasError = false
+	adhoc.Attempt = 0
+	adhoc.LastServer = ""
+	adhoc.CatchUp = 0
+	adhoc.BroadcastTick = time.Time{}
+	if b, err := adhoc.Serialize(); err != nil {
+		e = err
+	} else if err = ensurePath(fmt.Sprintf("%s/%s", PATH_ADHOC, job.Name)); err != nil {
+		e = err
+	} else if err = store.Create(adhoc.adhocPath(), b, false); err != nil {
+		e = fmt.Errorf("Unable to queue run of job %s: %s", job.Name, err.Error())
+	} else {
+		runID = adhoc.AdHoc
+		e = checkForNextjobUpdate(&adhoc, false)
+	}
+	return
+}
+
+// Return the path of a pending ad-hoc run /adhoc/<jobname>/<runid>
+func (job *Job) adhocPath() string {
+	return fmt.Sprintf("%s/%s/%s", PATH_ADHOC, job.Name, job.AdHoc)
+}
+
+// Get all pending ad-hoc runs, oldest first within each job
+func listAdhoc() (jobs []*Job, e error) {
+	jobnames, err := store.Children(PATH_ADHOC)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list ad-hoc runs: %s", err.Error())
+	}
+	sort.Strings(jobnames)
+	jobs = []*Job{}
+	for _, jobname := range jobnames {
+		runIDs, err := store.Children(fmt.Sprintf("%s/%s", PATH_ADHOC, jobname))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list ad-hoc runs of job %s: %s", jobname, err.Error())
+		}
+		sort.Strings(runIDs)
+		for _, runID := range runIDs {
+			znode := fmt.Sprintf("%s/%s/%s", PATH_ADHOC, jobname, runID)
+			if b, err := store.Get(znode); err == ErrNoNode {
+				continue // Run started since we listed the runs
+			} else if err != nil {
+				return nil, fmt.Errorf("Can't fetch ad-hoc run %s of job %s: %s", runID, jobname, err.Error())
+			} else if job, err := Deserialize(b); err != nil {
+				if err = quarantine(znode, b, err); err != nil {
+					return nil, err
+				}
+			} else {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return
+}
+
+// Remove an ad-hoc run that has been started from /adhoc and set the next scheduled job in /nextjob.
+// Like updateSchedule(), this releases the /jobs lock; the caller is responsible for obtaining it.
+func finishAdhoc(job *Job) error {
+	defer releaseJobsLock()
+	if err := store.Delete(job.adhocPath()); err != nil && err != ErrNoNode {
+		log.Error.Printf("Unable to remove ad-hoc run %s of job %s: %s", job.AdHoc, job.Name, err.Error())
+	}
+	store.Delete(fmt.Sprintf("%s/%s", PATH_ADHOC, job.Name)) // Fails harmlessly if other runs are pending
+	if err := setNextjob(); err != nil {
+		return err
+	}
+	return releaseJobsLock()
+}
@@ -0,0 +1,323 @@
+package cron
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+const (
+	DEFAULT_BROADCAST_DEADLINE = 10 * time.Minute // Default wait for every server to report on a broadcast run
+)
+
+var (
+	broadcastsChanged = make(chan struct{}, 1) // Signalled when a broadcast run starts or ends anywhere in the cluster
+)
+
+// Return how long the servers are waited for once a broadcast run is due
+func (job *Job) broadcastDeadline() time.Duration {
+	if job.Deadline > 0 {
+		return job.Deadline
+	}
+	return DEFAULT_BROADCAST_DEADLINE
+}
+
+// Return the name of the znode for a broadcast run due at a given time.  Names sort in order of the time.
+func broadcastTickName(tick time.Time) string {
+	return fmt.Sprintf("%019d", tick.UnixNano())
+}
+
+// Return the path of the broadcast run in progress /broadcast/<jobname>/<tick>
+func (job *Job) broadcastTickPath() string {
+	return fmt.Sprintf("%s/%s/%s", PATH_BROADCAST, job.Name, broadcastTickName(job.BroadcastTick))
+}
+
+// Start a broadcast run of a job that's due, or finish the one in progress, and release the /jobs lock.
+// Like updateSchedule(), the caller is responsible for obtaining it.
+func (job *Job) startBroadcast(now time.Time) error {
+	defer releaseJobsLock()
+	if err := job.beginBroadcast(now); err != nil {
+		return err
+	}
+	return releaseJobsLock() // Explicit unlock to ensure logging of any error
+}
+
+/*
+Start a broadcast run of a job that's due, or finish the one in progress if its
+deadline has passed.  Starting the run records its scheduled time in the job's
+BroadcastTick, moves its NextRuntime to the deadline so other jobs can be
+scheduled meanwhile, and creates /broadcast/<jobname>/<tick>, which every server
+watches for.  Each server that can run the job then runs it once.  The caller
+must hold the lock.
+*/
+func (job *Job) beginBroadcast(now time.Time) error {
+	if !job.BroadcastTick.IsZero() {
+		return finishBroadcast(job.Name, job.BroadcastTick)
+	}
+	if !job.applyMisfirePolicy(now) {
+		return rescheduleJob(job, false)
+	}
+	job.BroadcastTick = job.NextRuntime
+	job.NextRuntime = job.BroadcastTick.Add(job.broadcastDeadline())
+	if err := ensurePath(fmt.Sprintf("%s/%s", PATH_BROADCAST, job.Name)); err != nil {
+		return err
+	} else if err = ensurePath(job.broadcastTickPath()); err != nil {
+		return err
+	} else if err = job.UpdateZk(); err != nil {
+		log.Error.Println(err.Error())
+	} else {
+		log.Info.Printf("Broadcasting job %s scheduled for %s to all servers", job.Name, job.BroadcastTick.Format("2006-01-02 15:04:05"))
+	}
+	job.joinBroadcast()
+	return setNextjob()
+}
+
+/*
+Run the broadcast run of a job in progress on this server, unless this server
+has already claimed it or can't run the job.  The claim is znode
+/broadcast/<jobname>/<tick>/<servername>, which holds the RunRecord of the run
+once it's over.  The caller must hold the lock.
+*/
+func (job *Job) joinBroadcast() {
+	if !job.placeableOn(localServerInfo(true)) {
+		return
+	}
+	record := &RunRecord{Server: serverName, Start: time.Now()}
+	claimPath := fmt.Sprintf("%s/%s", job.broadcastTickPath(), serverName)
+	if b, err := gobEncode(record); err != nil {
+		log.Error.Printf("Unable to serialize broadcast run of job %s: %s", job.Name, err.Error())
+		return
+	} else if err = store.Create(claimPath, b, false); err == ErrNodeExists {
+		return // Already run on this server
+	} else if err != nil {
+		log.Error.Printf("Unable to claim broadcast run of job %s: %s", job.Name, err.Error())
+		return
+	}
+	runJob := *job
+	runJob.NextRuntime = job.BroadcastTick // The run's scheduled time, rather than the deadline
+	if ok, err := runJob.prepareRun(); err != nil || !ok {
+		record.End = record.Start
+		record.ExitCode = -1
+		record.Err = "Skipped as previous run still active"
+		if err != nil {
+			log.Error.Println(err.Error())
+			record.Err = err.Error()
+		}
+		if runJob.saveBroadcastReport(record) {
+			if err = finishBroadcast(job.Name, job.BroadcastTick); err != nil {
+				log.Error.Println(err.Error())
+			}
+		}
+	} else {
+		go runJob.Run()
+	}
+}
+
+// Record the end of this server's broadcast run of a job and ask the server loop to check whether
+// every server has now reported
+func (job *Job) reportBroadcast(record *RunRecord) {
+	if !job.saveBroadcastReport(record) {
+		return
+	}
+	name, tick := job.Name, job.BroadcastTick
+	submitLocked(func() {
+		if err := finishBroadcast(name, tick); err != nil {
+			log.Error.Println(err.Error())
+		}
+	})
+}
+
+// Save the RunRecord of this server's broadcast run of a job in its claim, returning whether the
+// broadcast run is still in progress, so it may now be finished
+func (job *Job) saveBroadcastReport(record *RunRecord) bool {
+	claimPath := fmt.Sprintf("%s/%s", job.broadcastTickPath(), serverName)
+	if b, err := gobEncode(record); err != nil {
+		log.Error.Printf("Unable to serialize broadcast run of job %s: %s", job.Name, err.Error())
+		return false
+	} else if err = store.Set(claimPath, b); err == ErrNoNode {
+		log.Trace.Printf("Broadcast run of job %s finished before this server reported", job.Name)
+		return false
+	} else if err != nil {
+		log.Error.Printf("Unable to report broadcast run of job %s: %s", job.Name, err.Error())
+		return false
+	}
+	return true
+}
+
+// Get the reports of each server on the broadcast run of a job in progress, by server name
+func (job *Job) broadcastReports() (reports map[string]*RunRecord, e error) {
+	servers, err := store.Children(job.broadcastTickPath())
+	if err == ErrNoNode {
+		return map[string]*RunRecord{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to list broadcast runs of job %s: %s", job.Name, err.Error())
+	}
+	reports = map[string]*RunRecord{}
+	for _, server := range servers {
+		record := &RunRecord{}
+		if b, err := store.Get(fmt.Sprintf("%s/%s", job.broadcastTickPath(), server)); err == ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Can't fetch broadcast run of job %s on server %s: %s", job.Name, server, err.Error())
+		} else if err = gobDecode(b, record); err != nil {
+			log.Warning.Printf("Unable to decode broadcast run of job %s on server %s: %s", job.Name, server, err.Error())
+		}
+		reports[server] = record
+	}
+	return
+}
+
+// Return the names of the running servers that can run a broadcast job but haven't reported on its run
+func (job *Job) pendingBroadcast(servers map[string]*ServerInfo, reports map[string]*RunRecord) []string {
+	pending := []string{}
+	for _, info := range servers {
+		if record := reports[info.Name]; job.placeableOn(info) && (record == nil || record.End.IsZero()) {
+			pending = append(pending, info.Name)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+/*
+Finish the broadcast run of a job due at a given time if every running server
+that can run the job has reported, or its deadline has passed.  The job is then
+rescheduled from its schedule and the jobs that depend on it are triggered once,
+as succeeding only if every server's run succeeded.  The caller must hold the lock.
+*/
+func finishBroadcast(name string, tick time.Time) error {
+	job, err := getJob(name)
+	if err != nil {
+		log.Trace.Printf("Broadcast job %s no longer exists: %s", name, err.Error())
+		return deleteTree(fmt.Sprintf("%s/%s", PATH_BROADCAST, name))
+	}
+	if !job.BroadcastTick.Equal(tick) {
+		return nil // Already finished
+	}
+	reports, err := job.broadcastReports()
+	if err != nil {
+		return err
+	}
+	servers, err := getServers()
+	if err != nil {
+		return err
+	}
+	pending := job.pendingBroadcast(servers, reports)
+	if len(pending) > 0 && job.NextRuntime.After(time.Now()) {
+		return nil
+	}
+	failed := []string{}
+	for server, record := range reports {
+		if record.Err != "" {
+			failed = append(failed, server)
+		}
+	}
+	sort.Strings(failed)
+	record := &RunRecord{RunID: broadcastTickName(tick)}
+	if len(pending) > 0 {
+		log.Warning.Printf("Broadcast run of job %s reached its deadline without reports from server(s) %v", name, pending)
+		record.Err = fmt.Sprintf("No report from server(s) %v", pending)
+	} else if len(failed) > 0 {
+		log.Warning.Printf("Broadcast run of job %s failed on server(s) %v", name, failed)
+		record.Err = fmt.Sprintf("Failed on server(s) %v", failed)
+	} else {
+		log.Info.Printf("Broadcast run of job %s complete on %d server(s)", name, len(reports))
+	}
+	if err = deleteTree(fmt.Sprintf("%s/%s", PATH_BROADCAST, name)); err != nil {
+		log.Warning.Println(err.Error())
+	}
+	job.queueDependents(record)
+
+	// Reschedule from the run's scheduled time, which continues any catch-up of missed runs.
+	// A one-shot job is retired now, as its runs are over.
+	job.NextRuntime = tick
+	job.BroadcastTick = time.Time{}
+	return rescheduleJob(job, false)
+}
+
+/*
+Run this server's part of every broadcast run in progress and finish any that
+no longer wait for a server, e.g. because the servers that hadn't reported have
+stopped.  Broadcast runs left behind by a job that has since been updated or
+deleted are discarded, along with the job's znode once it has no runs left.
+The caller must hold the lock.
+*/
+func checkBroadcasts() error {
+	jobnames, err := store.Children(PATH_BROADCAST)
+	if err != nil {
+		return fmt.Errorf("Unable to check for broadcast runs: %s", err.Error())
+	}
+	for _, jobname := range jobnames {
+		jobPath := fmt.Sprintf("%s/%s", PATH_BROADCAST, jobname)
+		ticks, err := store.Children(jobPath)
+		if err == ErrNoNode {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Unable to check for broadcast runs of job %s: %s", jobname, err.Error())
+		}
+		job, err := getJob(jobname)
+		if err != nil {
+			log.Trace.Printf("Broadcast job %s no longer exists: %s", jobname, err.Error())
+			if err = deleteTree(jobPath); err != nil {
+				log.Warning.Println(err.Error())
+			}
+			continue
+		}
+		for _, tick := range ticks {
+			if job.BroadcastTick.IsZero() || tick != broadcastTickName(job.BroadcastTick) {
+				log.Trace.Printf("Discarding stale broadcast run %s of job %s", tick, jobname)
+				if err = deleteTree(fmt.Sprintf("%s/%s", jobPath, tick)); err != nil {
+					log.Warning.Println(err.Error())
+				}
+				continue
+			}
+			job.joinBroadcast()
+			if err = finishBroadcast(job.Name, job.BroadcastTick); err != nil {
+				log.Error.Println(err.Error())
+			}
+		}
+
+		// Delete the job's znode once its stale runs are gone, so the next run's creation of it
+		// fires the servers' watches on /broadcast
+		if ticks, err = store.Children(jobPath); err == nil && len(ticks) == 0 {
+			if err = store.Delete(jobPath); err != nil && err != ErrNoNode && err != ErrNotEmpty {
+				log.Warning.Printf("Unable to delete broadcast runs of job %s: %s", jobname, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Signal the server loop whenever a broadcast run starts or ends anywhere in the cluster
+func watchBroadcasts(done <-chan struct{}) {
+	serverWatchers.Add(1)
+	go func() {
+		defer serverWatchers.Done()
+		for isRunning() {
+			_, watch, err := store.ChildrenW(PATH_BROADCAST)
+			if err != nil {
+				log.Error.Printf("Can't watch for broadcast runs: %s", err.Error())
+				break
+			}
+			var evt Event
+			select {
+			case evt = <-watch:
+			case <-done:
+				return
+			}
+			if evt.Err != nil {
+				log.Error.Printf("Error watching for broadcast runs: %s", evt.Err.Error())
+				break
+			}
+			select {
+			case broadcastsChanged <- struct{}{}:
+			default: // Signal already pending
+			}
+		}
+		if isRunning() {
+			log.Error.Printf("%s broadcast watch terminated due to previous error", APP_NAME)
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package cron
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPendingBroadcast(t *testing.T) {
+	servers := map[string]*ServerInfo{
+		"a":   {Name: "a"},
+		"b":   {Name: "b"},
+		"c":   {Name: "c"},
+		"db1": {Name: "db1", Labels: map[string]string{"role": "db"}},
+	}
+	now := time.Now()
+	reports := map[string]*RunRecord{
+		"a":       {Server: "a", Start: now, End: now},
+		"b":       {Server: "b", Start: now},
+		"stopped": {Server: "stopped", Start: now},
+	}
+	tests := []struct {
+		job     Job
+		pending string
+	}{
+		{Job{Name: "all", Broadcast: true}, "[b c db1]"},
+		{Job{Name: "db", Broadcast: true, Selector: "role=db"}, "[db1]"},
+		{Job{Name: "web", Broadcast: true, Selector: "!role"}, "[b c]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(test.job.pendingBroadcast(servers, reports)); got != test.pending {
+			t.Errorf("Job %s: pending %s; expected %s", test.job.Name, got, test.pending)
+		}
+	}
+}
+
+func TestValidateBroadcast(t *testing.T) {
+	tests := []struct {
+		job   Job
+		valid bool
+	}{
+		{Job{Name: "broadcast", Schedule: "@daily", Broadcast: true}, true},
+		{Job{Name: "deadline", Schedule: "@daily", Broadcast: true, Deadline: time.Hour}, true},
+		{Job{Name: "notbroadcast", Schedule: "@daily", Deadline: time.Hour}, false},
+		{Job{Name: "negative", Schedule: "@daily", Broadcast: true, Deadline: -time.Hour}, false},
+		{Job{Name: "retries", Schedule: "@daily", Broadcast: true, MaxRetries: 2}, false},
+	}
+	for _, test := range tests {
+		if err := test.job.Validate(); (err == nil) != test.valid {
+			t.Errorf("Job %s: valid %v; expected %v (%v)", test.job.Name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestDiscardStaleBroadcast(t *testing.T) {
+	useMemoryStore(t)
+	addJob(t, &Job{Name: "stale", Schedule: "@daily", Broadcast: true, Cmd: "true"})
+	jobPath := fmt.Sprintf("%s/%s", PATH_BROADCAST, "stale")
+	for _, znode := range []string{jobPath, fmt.Sprintf("%s/%s", jobPath, broadcastTickName(time.Now()))} {
+		if err := store.Create(znode, []byte{}, false); err != nil {
+			t.Fatalf("Can't create %s: %s", znode, err.Error())
+		}
+	}
+	if err := checkBroadcasts(); err != nil {
+		t.Fatalf("Can't check broadcast runs: %s", err.Error())
+	}
+	if jobnames, err := store.Children(PATH_BROADCAST); err != nil || len(jobnames) != 0 {
+		t.Errorf("Broadcast runs %v left after discarding a stale run: %v", jobnames, err)
+	}
+}
+
+func TestFinishBroadcastInServerLoop(t *testing.T) {
+	useMemoryStore(t)
+	serverName = "local"
+	addJob(t, &Job{Name: "all", Schedule: "@daily", Broadcast: true, Concurrency: CONCURRENCY_FORBID, Cmd: "true"})
+	addJob(t, &Job{Name: "after", Schedule: "-", Cmd: "true", AfterAny: []string{"all"}})
+
+	// A run still active on this server makes its part of the broadcast run fail without running,
+	// which finishes the broadcast run as no other server is waited for
+	store.Create(PATH_RUNNING+"/all", []byte{}, false)
+	store.Create(PATH_RUNNING+"/all/previous", []byte(serverName), true)
+	job, err := getJob("all")
+	if err != nil {
+		t.Fatalf("Can't get job: %s", err.Error())
+	} else if err = getJobsLock(); err != nil {
+		t.Fatalf("Can't get lock: %s", err.Error())
+	}
+	err = job.beginBroadcast(job.NextRuntime)
+	releaseJobsLock()
+	if err != nil {
+		t.Fatalf("Can't start broadcast run: %s", err.Error())
+	}
+
+	// The work is done directly rather than queued for the server loop, which is the caller
+	if n := len(lockedRequests); n != 0 {
+		t.Errorf("%d request(s) queued for the server loop by the server loop", n)
+	}
+	if adhocs, err := listAdhoc(); err != nil || len(adhocs) != 1 || adhocs[0].Name != "after" {
+		t.Errorf("Unexpected ad-hoc runs %v: %v", adhocs, err)
+	}
+	if job, err = getJob("all"); err != nil || !job.BroadcastTick.IsZero() {
+		t.Errorf("Broadcast run not finished: %+v %v", job, err)
+	}
+}
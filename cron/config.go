@@ -0,0 +1,121 @@
+package cron
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Cluster-wide settings, stored in znode /config and maintained by the config command
+type ClusterConfig struct {
+	Jitter     time.Duration // Default jitter window for jobs that don't set one; 0 => no jitter
+	JitterMode string        // Default jitter mode for jobs that don't set one: hash or random; "" => hash
+	Placement  string        // Default placement strategy for jobs that don't set one; "" => random
+	JobSchema  int           // Schema version of the JSON jobs are written in, set by the migrate command; 0 => legacy gob encoding
+}
+
+// The cluster configuration as last read, which is dropped when /config changes, so scheduling
+// every job doesn't read it again
+var (
+	cachedConfig      *ClusterConfig
+	cachedConfigStore Store // Store the cached configuration was read from
+	configMutex       sync.Mutex
+)
+
+// Get the cluster configuration.  It's empty if it has never been set or there's no connection.
+func GetConfig() (config *ClusterConfig, e error) {
+	config = &ClusterConfig{}
+	if store == nil {
+		return
+	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if cachedConfig == nil || cachedConfigStore != store {
+		cached := &ClusterConfig{}
+		b, watch, err := store.GetW(PATH_CONFIG)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch cluster configuration: %s", err.Error())
+		} else if err = decodeConfig(b, cached); err != nil {
+			return nil, fmt.Errorf("Unable to decode cluster configuration: %s", err.Error())
+		}
+		cachedConfig, cachedConfigStore = cached, store
+		go func() {
+			<-watch
+			dropConfig(cached)
+		}()
+	}
+	*config = *cachedConfig // A copy, which the caller can change
+	return
+}
+
+// Drop the cached cluster configuration if it's the one given, or any if nil
+func dropConfig(cached *ClusterConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if cached == nil || cachedConfig == cached {
+		cachedConfig = nil
+	}
+}
+
+/*
+Save the cluster configuration in /config.  It's saved while holding the lock,
+as migrate does when it sets the job schema, and a newer schema version already
+in /config is kept, so saving settings read before a migration doesn't switch
+the cluster back to writing jobs in the legacy gob encoding.
+*/
+func (config *ClusterConfig) Save() (e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	current := &ClusterConfig{}
+	if b, err := store.Get(PATH_CONFIG); err != nil {
+		return fmt.Errorf("Unable to fetch cluster configuration: %s", err.Error())
+	} else if err = decodeConfig(b, current); err != nil {
+		log.Warning.Printf("Replacing cluster configuration that can't be decoded: %s", err.Error())
+	}
+	if current.JobSchema > config.JobSchema {
+		config.JobSchema = current.JobSchema
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	} else if b, err := json.Marshal(config); err != nil {
+		return fmt.Errorf("Unable to serialize cluster configuration: %s", err.Error())
+	} else if err = store.Set(PATH_CONFIG, b); err != nil {
+		return fmt.Errorf("Unable to save cluster configuration: %s", err.Error())
+	}
+	dropConfig(nil)
+	log.Trace.Printf("Saved cluster configuration %+v", *config)
+	return nil
+}
+
+// Decode the data of /config, which is JSON, or gob as written by earlier releases.  Empty data,
+// as /config holds until it's first saved, leaves the configuration empty.
+func decodeConfig(b []byte, config *ClusterConfig) error {
+	if len(b) == 0 {
+		return nil
+	} else if IsLegacyJob(b) {
+		return gobDecode(b, config)
+	}
+	return json.Unmarshal(b, config)
+}
+
+// Check the settings of a cluster configuration built by the CLI
+func (config *ClusterConfig) Validate() error {
+	if config.Jitter < 0 {
+		return fmt.Errorf("Invalid negative default jitter %v", config.Jitter)
+	} else if !validJitterMode(config.JitterMode) || config.JitterMode == JITTER_NONE {
+		return fmt.Errorf("Invalid default jitter mode \"%s\"; must be %s or %s", config.JitterMode, JITTER_HASH, JITTER_RANDOM)
+	} else if !validPlacement(config.Placement) {
+		return fmt.Errorf("Invalid default placement \"%s\"; must be one of %s", config.Placement, strings.Join(PlacementNames(), ", "))
+	} else if config.JobSchema < 0 || config.JobSchema > JOB_SCHEMA_VERSION {
+		return fmt.Errorf("Invalid job schema version %d; this release writes version %d", config.JobSchema, JOB_SCHEMA_VERSION)
+	}
+	return nil
+}
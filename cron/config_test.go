@@ -0,0 +1,39 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigCache(t *testing.T) {
+	useMemoryStore(t)
+	if config, err := GetConfig(); err != nil || config.Jitter != 0 {
+		t.Fatalf("Unexpected initial configuration %+v: %v", config, err)
+	}
+	config := &ClusterConfig{Jitter: time.Minute}
+	if err := config.Save(); err != nil {
+		t.Fatalf("Can't save configuration: %s", err.Error())
+	} else if got, err := GetConfig(); err != nil || got.Jitter != time.Minute {
+		t.Errorf("Saved configuration not read back: %+v %v", got, err)
+	}
+	got, _ := GetConfig()
+	got.Jitter = time.Hour
+	if again, _ := GetConfig(); again.Jitter != time.Minute {
+		t.Errorf("Change to a returned configuration changed the cache: %+v", again)
+	}
+
+	// A change by another session, such as the CLI, reaches the cache through its watch
+	cli := store.(*MemoryStore).NewSession()
+	defer cli.Close()
+	b, _ := gobEncode(&ClusterConfig{Jitter: time.Second})
+	if err := cli.Set(PATH_CONFIG, b); err != nil {
+		t.Fatalf("Can't set configuration: %s", err.Error())
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got, err := GetConfig(); err == nil && got.Jitter == time.Second {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Cached configuration %+v not refreshed: %v", got, err)
+		}
+	}
+}
@@ -5,64 +5,131 @@ This package supports both the server and a CLI for maintaining the schedule.
 package cron
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"os"
 	"sort"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
-	"github.com/samuel/go-zookeeper/zk"
 	log "github.com/tooda02/castle-cron/logging"
 )
 
 // Zookeeper nodes used by this application
 const (
-	APP_NAME      = "castle-cron"
-	NAMESPACE     = "/" + APP_NAME         // Root node; can be set to empty string if desired
-	PATH_SERVERS  = NAMESPACE + "/servers" // Root of ephemeral nodes for each server
-	PATH_JOBS     = NAMESPACE + "/jobs"    // Root of nodes for each job
-	PATH_NEXT_JOB = NAMESPACE + "/nextjob" // Single node holding next job to run
-	PATH_JOBLOCK  = NAMESPACE + "/joblock" // Single node holding lock
+	APP_NAME        = "castle-cron"
+	NAMESPACE       = "/" + APP_NAME            // Root node; can be set to empty string if desired
+	PATH_SERVERS    = NAMESPACE + "/servers"    // Root of ephemeral nodes for each server
+	PATH_JOBS       = NAMESPACE + "/jobs"       // Root of nodes for each job
+	PATH_NEXT_JOB   = NAMESPACE + "/nextjob"    // Single node holding next job to run
+	PATH_JOBLOCK    = NAMESPACE + "/joblock"    // Single node holding lock
+	PATH_RUNS       = NAMESPACE + "/runs"       // Root of nodes holding output of recent runs of each job
+	PATH_HISTORY    = NAMESPACE + "/history"    // Root of nodes holding run history of each job
+	PATH_RUNNING    = NAMESPACE + "/running"    // Root of ephemeral nodes for each active run of each job
+	PATH_INFLIGHT   = NAMESPACE + "/inflight"   // Root of nodes for each started but incomplete run of each job
+	PATH_ADHOC      = NAMESPACE + "/adhoc"      // Root of nodes for each pending ad-hoc run of each job
+	PATH_ARCHIVE    = NAMESPACE + "/archive"    // Root of nodes for each one-shot job kept after its run
+	PATH_CONFIG     = NAMESPACE + "/config"     // Single node holding cluster-wide settings
+	PATH_BROADCAST  = NAMESPACE + "/broadcast"  // Root of nodes for each server's report on the broadcast run in progress of each job
+	PATH_QUARANTINE = NAMESPACE + "/quarantine" // Root of nodes holding job data that couldn't be decoded, under its original path
+	PATH_CLAIMS     = NAMESPACE + "/claims"     // Root of ephemeral nodes for each server's claim to a due run of each job
 )
 
 var (
-	zkConn     *zk.Conn // Zookeeper connection for both server and CLI
-	hostname   string   // hostname (set for server only)
-	serverName string   // server name (set for server only; defaults to hostname)
-	isRunning  bool     // Server is running
+	store          Store                    // Coordination store, normally Zookeeper, for both server and CLI
+	hostname       string                   // hostname (set for server only)
+	serverName     string                   // server name (set for server only; defaults to hostname)
+	running        int32                    // Nonzero while the server is running; see isRunning()
+	serverDone     chan struct{}            // Closed by Stop() to end the server's watch goroutines
+	serverWatchers sync.WaitGroup           // The server's watch goroutines, joined by Stop()
+	serversStopped = make(chan struct{}, 1) // Signalled when another server leaves the cluster
+	serversStarted = make(chan struct{}, 1) // Signalled when another server joins the cluster
 )
 
-// Connect to Zookeeper
-func Init(server string, timeout int) (e error) {
-	if zkConn != nil {
-		e = fmt.Errorf("cron Init() called more than once")
-	} else {
-		if hostname, e = os.Hostname(); e != nil {
-			hostname = fmt.Sprintf("unknown-%d", os.Getpid())
-			log.Warning.Printf("castle-cron running on unknown host (%s)", e.Error())
-		}
-		zks := strings.Split(server, ",")
-		if zkConn, _, e = zk.Connect(zks, time.Duration(timeout)*time.Second); e == nil {
-			log.Trace.Printf("Zookeeper connection %#v", zkConn)
-			createIfNecessary(NAMESPACE)
-			createIfNecessary(PATH_JOBS)
-			createIfNecessary(PATH_NEXT_JOB)
-			createIfNecessary(PATH_SERVERS)
-			createIfNecessary(PATH_JOBLOCK)
-			lock = zk.NewLock(zkConn, PATH_JOBLOCK, zk.WorldACL(zk.PermAll))
+// Connect to the store at an address: Zookeeper servers, an etcd:// cluster, or a file:// directory
+func Init(server string, timeout int) error {
+	if store != nil {
+		return fmt.Errorf("cron Init() called more than once")
+	}
+	s, err := ConnectStore(server, timeout)
+	if err != nil {
+		return err
+	}
+	log.Trace.Printf("Store connection to %s", server)
+	return InitStore(s)
+}
+
+// Use a connected store, such as a MemoryStore, creating the nodes used by this application
+func InitStore(s Store) (e error) {
+	if store != nil {
+		return fmt.Errorf("cron Init() called more than once")
+	}
+	if hostname, e = os.Hostname(); e != nil {
+		hostname = fmt.Sprintf("unknown-%d", os.Getpid())
+		log.Warning.Printf("castle-cron running on unknown host (%s)", e.Error())
+	}
+	store = s
+	for _, znode := range []string{NAMESPACE, PATH_JOBS, PATH_NEXT_JOB, PATH_SERVERS, PATH_JOBLOCK, PATH_RUNS, PATH_HISTORY,
+		PATH_RUNNING, PATH_INFLIGHT, PATH_ADHOC, PATH_ARCHIVE, PATH_CONFIG, PATH_BROADCAST, PATH_QUARANTINE, PATH_CLAIMS} {
+		if e = ensurePath(znode); e != nil {
+			store.Close()
+			store = nil
+			return e
 		}
 	}
+	lock = store.NewLock(PATH_JOBLOCK)
+	if e = initConfig(); e != nil {
+		store.Close()
+		store = nil
+	}
 	return
 }
 
+// Start a new cluster writing jobs as JSON.  A cluster that already has jobs keeps the
+// encoding in /config, which is the legacy gob encoding until it's migrated.
+func initConfig() error {
+	if b, err := store.Get(PATH_CONFIG); err != nil {
+		return fmt.Errorf("Unable to fetch cluster configuration: %s", err.Error())
+	} else if len(b) > 0 {
+		return nil
+	} else if jobs, err := store.Children(PATH_JOBS); err != nil {
+		return fmt.Errorf("Unable to list %s: %s", PATH_JOBS, err.Error())
+	} else if len(jobs) > 0 {
+		return nil
+	}
+	return (&ClusterConfig{JobSchema: JOB_SCHEMA_VERSION}).Save()
+}
+
 // Shut down
 func Stop() {
-	if zkConn == nil {
+	if store == nil {
 		log.Warning.Printf("cron Close called when cron server not started")
 	} else {
-		zkConn.Close()
-		zkConn = nil
-		log.Trace.Printf("Closed Zookeeper connection")
+		setRunning(false)
+		if serverDone != nil {
+			close(serverDone)
+			serverWatchers.Wait()
+			serverDone = nil
+		}
+		store.Close()
+		store = nil
+		log.Trace.Printf("Closed store connection")
+	}
+}
+
+// Report whether the server is running; the flag is read by the server's watch goroutines
+func isRunning() bool {
+	return atomic.LoadInt32(&running) != 0
+}
+
+// Set whether the server is running
+func setRunning(r bool) {
+	if r {
+		atomic.StoreInt32(&running, 1)
+	} else {
+		atomic.StoreInt32(&running, 0)
 	}
 }
 
@@ -75,16 +142,20 @@ func setServerName(name string, force bool) error {
 		serverName = strings.Replace(serverName, "%p", fmt.Sprintf("%d", os.Getpid()), -1)
 	}
 	serverPath := fmt.Sprintf("%s/%s", PATH_SERVERS, serverName)
-	if exists, _, err := zkConn.Exists(serverPath); err != nil {
+	if exists, err := store.Exists(serverPath); err != nil {
 		return fmt.Errorf("Unable to check server existence: %s", err.Error())
 	} else if exists {
 		if !force {
 			return fmt.Errorf("Server %s is already running.  Use -f argument to run anyway.", serverName)
 		}
 		log.Warning.Printf("Deleting previously-existing znode %s", serverPath)
-		zkConn.Delete(serverPath, -1)
+		store.Delete(serverPath)
+	}
+	b, err := gobEncode(localServerInfo(false))
+	if err != nil {
+		return fmt.Errorf("Unable to serialize server information: %s", err.Error())
 	}
-	if _, err := zkConn.Create(serverPath, []byte(APP_NAME), zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+	if err := store.Create(serverPath, b, true); err != nil {
 		return fmt.Errorf("Unable to create znode %s: %s", serverPath, err.Error())
 	} else {
 		log.Trace.Printf("Created znode %s", serverPath)
@@ -94,8 +165,8 @@ func setServerName(name string, force bool) error {
 
 // Tell user this server has started, log a list of all servers running,
 // and report when any other server starts or stops
-func reportServers() error {
-	allServers, _, watch, err := zkConn.ChildrenW(PATH_SERVERS)
+func reportServers(done <-chan struct{}) error {
+	allServers, watch, err := store.ChildrenW(PATH_SERVERS)
 	if err != nil {
 		return fmt.Errorf("Can't get list of %s servers: %s", APP_NAME, err.Error())
 	}
@@ -110,15 +181,23 @@ func reportServers() error {
 		}
 		sort.Strings(allServers)
 	}
-	log.Info.Printf("%s server %s started; %d server(s) running %v", APP_NAME, serverName, len(allServers), allServers)
+	log.Info.Printf("%s server %s started with labels [%s]; %d server(s) running %v",
+		APP_NAME, serverName, FormatLabels(ServerLabels), len(allServers), allServers)
+	serverWatchers.Add(1)
 	go func() {
-		for isRunning {
-			evt := <-watch
+		defer serverWatchers.Done()
+		for isRunning() {
+			var evt Event
+			select {
+			case evt = <-watch:
+			case <-done:
+				return
+			}
 			if evt.Err != nil {
 				log.Error.Printf("Error watching for changes in server list: %s", evt.Err.Error())
 				break
 			}
-			allServers, _, watch, err = zkConn.ChildrenW(PATH_SERVERS)
+			allServers, watch, err = store.ChildrenW(PATH_SERVERS)
 			if err != nil {
 				log.Error.Printf("Can't get updated list of %s servers: %s", APP_NAME, err.Error())
 				break
@@ -142,28 +221,70 @@ func reportServers() error {
 			if len(newServers) > 0 {
 				sort.Strings(newServers)
 				log.Info.Printf("New %s server(s) %v started; %d server(s) now running %v", APP_NAME, newServers, len(allServers), allServers)
+				select {
+				case serversStarted <- struct{}{}:
+				default: // Signal already pending
+				}
 			}
 			if len(deletedServers) > 0 {
 				sort.Strings(deletedServers)
 				log.Info.Printf("%s server(s) %v stopped; %d server(s) now running %v", APP_NAME, deletedServers, len(allServers), allServers)
+				select {
+				case serversStopped <- struct{}{}:
+				default: // Signal already pending
+				}
 			}
 		}
-		if isRunning {
+		if isRunning() {
 			log.Error.Printf("%s server change reporting terminated due to previous error", APP_NAME)
 		}
 	}()
 	return nil
 }
 
-// Check whether a specified znode exists and create if it does not
-func createIfNecessary(znode string) {
+// Check whether a specified znode exists and create if it does not, returning any error
+func ensurePath(znode string) error {
 	if znode != "" {
-		if exists, _, err := zkConn.Exists(znode); err != nil {
-			log.Error.Fatalf("Unable to check for %s: %s", znode, err.Error())
+		if exists, err := store.Exists(znode); err != nil {
+			return fmt.Errorf("Unable to check for %s: %s", znode, err.Error())
 		} else if !exists {
-			if _, err = zkConn.Create(znode, []byte{}, 0x0, zk.WorldACL(zk.PermAll)); err != nil {
-				log.Error.Fatalf("Unable to create %s: %s", znode, err.Error())
+			if err = store.Create(znode, []byte{}, false); err != nil && err != ErrNodeExists {
+				return fmt.Errorf("Unable to create %s: %s", znode, err.Error())
 			}
 		}
 	}
+	return nil
+}
+
+// Delete a znode and all of its children
+func deleteTree(znode string) error {
+	children, err := store.Children(znode)
+	if err == ErrNoNode {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to list children of %s: %s", znode, err.Error())
+	}
+	for _, child := range children {
+		if err = deleteTree(fmt.Sprintf("%s/%s", znode, child)); err != nil {
+			return err
+		}
+	}
+	if err = store.Delete(znode); err != nil && err != ErrNoNode {
+		return fmt.Errorf("Unable to delete %s: %s", znode, err.Error())
+	}
+	return nil
+}
+
+// Serialize a struct other than a Job into a byte array
+func gobEncode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Deserialize a byte array produced by gobEncode()
+func gobDecode(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
 }
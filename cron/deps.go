@@ -0,0 +1,143 @@
+package cron
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Return the names of the jobs a job depends on
+func (job *Job) DependsOn() []string {
+	names := append(append([]string{}, job.AfterSuccess...), job.AfterAny...)
+	sort.Strings(names)
+	return names
+}
+
+// Check whether a job's dependencies call for it to run after a run of another job with a given result
+func (job *Job) triggeredBy(name string, succeeded bool) bool {
+	for _, upstream := range job.AfterAny {
+		if upstream == name {
+			return true
+		}
+	}
+	if succeeded {
+		for _, upstream := range job.AfterSuccess {
+			if upstream == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check that a job's dependencies are well formed
+func (job *Job) validateDependencies() error {
+	seen := map[string]bool{}
+	for _, upstream := range job.DependsOn() {
+		if upstream == "" {
+			return fmt.Errorf("Empty dependency for job %s", job.Name)
+		} else if upstream == job.Name {
+			return fmt.Errorf("Job %s can't depend on itself", job.Name)
+		} else if seen[upstream] {
+			return fmt.Errorf("Job %s depends on job %s more than once", job.Name, upstream)
+		}
+		seen[upstream] = true
+	}
+	return nil
+}
+
+/*
+Check that the jobs a job depends on exist and that adding or updating the job
+doesn't create a dependency cycle, which would trigger runs endlessly.
+*/
+func (job *Job) CheckDependencies() error {
+	if len(job.AfterSuccess) == 0 && len(job.AfterAny) == 0 {
+		return nil
+	}
+	jobs, err := ListJobs("")
+	if err != nil {
+		return err
+	}
+	graph := map[string][]string{}
+	for _, other := range jobs {
+		graph[other.Name] = other.DependsOn()
+	}
+	graph[job.Name] = job.DependsOn()
+	for _, upstream := range graph[job.Name] {
+		if _, ok := graph[upstream]; !ok {
+			return fmt.Errorf("Job %s depends on job %s, which doesn't exist", job.Name, upstream)
+		}
+	}
+	return checkDependencyCycle(graph, job.Name)
+}
+
+// Check for a path from a job back to itself in a map of each job's dependencies
+func checkDependencyCycle(graph map[string][]string, name string) error {
+	var visit func(path []string) error
+	visited := map[string]bool{}
+	visit = func(path []string) error {
+		for _, upstream := range graph[path[len(path)-1]] {
+			if upstream == name {
+				return fmt.Errorf("Dependencies of job %s form a cycle: %v", name, append(path, upstream))
+			} else if !visited[upstream] {
+				visited[upstream] = true
+				if err := visit(append(path, upstream)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit([]string{name})
+}
+
+// Return the names of the jobs that depend on a job, sorted
+func (job *Job) Dependents() (names []string, e error) {
+	jobs, err := ListJobs("")
+	if err != nil {
+		return nil, err
+	}
+	names = []string{}
+	for _, other := range jobs {
+		for _, upstream := range other.DependsOn() {
+			if upstream == job.Name {
+				names = append(names, other.Name)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Ask the server loop to queue runs of the jobs that depend on a run of this job that has ended
+func (job *Job) triggerDependents(record *RunRecord) {
+	submitLocked(func() {
+		job.queueDependents(record)
+	})
+}
+
+/*
+Queue ad-hoc runs of the jobs that depend on a run of this job that has ended,
+so they run through the scheduler like any other run.  Paused jobs aren't
+triggered.  The caller must hold the lock.
+*/
+func (job *Job) queueDependents(record *RunRecord) {
+	succeeded := record.Err == ""
+	jobs, err := ListJobs("")
+	if err != nil {
+		log.Error.Printf("Unable to trigger jobs that depend on job %s: %s", job.Name, err.Error())
+		return
+	}
+	for _, dependent := range jobs {
+		if !dependent.triggeredBy(job.Name, succeeded) {
+			continue
+		} else if dependent.Paused {
+			log.Info.Printf("Not triggering job %s after job %s as it's paused", dependent.Name, job.Name)
+		} else if runID, err := dependent.runAfter(job.Name); err != nil {
+			log.Error.Println(err.Error())
+		} else {
+			log.Info.Printf("Run %s of job %s triggered by run %s of job %s", runID, dependent.Name, record.RunID, job.Name)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cron
+
+import (
+	"testing"
+)
+
+func TestDependencyCycle(t *testing.T) {
+	graph := map[string][]string{
+		"extract":   {},
+		"transform": {"extract"},
+		"load":      {"transform"},
+		"report":    {"load", "extract"},
+	}
+	for name := range graph {
+		if err := checkDependencyCycle(graph, name); err != nil {
+			t.Errorf("Unexpected cycle: %s", err.Error())
+		}
+	}
+	graph["extract"] = []string{"report"}
+	if err := checkDependencyCycle(graph, "extract"); err == nil {
+		t.Errorf("Expected cycle extract -> report -> load -> transform -> extract")
+	}
+
+	job := &Job{Name: "self", AfterSuccess: []string{"self"}}
+	if err := job.validateDependencies(); err == nil {
+		t.Errorf("Job %s: expected error for dependency on itself", job.Name)
+	}
+}
+
+func TestTriggeredBy(t *testing.T) {
+	job := &Job{Name: "load", AfterSuccess: []string{"transform"}, AfterAny: []string{"cleanup"}}
+	tests := []struct {
+		upstream  string
+		succeeded bool
+		triggered bool
+	}{
+		{"transform", true, true},
+		{"transform", false, false},
+		{"cleanup", true, true},
+		{"cleanup", false, true},
+		{"extract", true, false},
+	}
+	for _, test := range tests {
+		if got := job.triggeredBy(test.upstream, test.succeeded); got != test.triggered {
+			t.Errorf("Job %s after %s (succeeded %v): triggered %v; expected %v",
+				job.Name, test.upstream, test.succeeded, got, test.triggered)
+		}
+	}
+}
+
+func TestDependents(t *testing.T) {
+	useMemoryStore(t)
+	addJob(t, &Job{Name: "extract", Schedule: "@hourly", Cmd: "true"})
+	addJob(t, &Job{Name: "transform", Schedule: "-", Cmd: "true", AfterSuccess: []string{"extract"}})
+	addJob(t, &Job{Name: "cleanup", Schedule: "-", Cmd: "true", AfterAny: []string{"extract"}})
+	extract := &Job{Name: "extract"}
+	if dependents, err := extract.Dependents(); err != nil || len(dependents) != 2 || dependents[0] != "cleanup" || dependents[1] != "transform" {
+		t.Errorf("Unexpected dependents of job extract %v: %v", dependents, err)
+	}
+	if dependents, err := (&Job{Name: "transform"}).Dependents(); err != nil || len(dependents) != 0 {
+		t.Errorf("Unexpected dependents of job transform %v: %v", dependents, err)
+	}
+}
@@ -0,0 +1,304 @@
+//go:build etcd
+// +build etcd
+
+package cron
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+/*
+A Store backed by an etcd v3 cluster.  Each node is a key named by its path,
+so the children of a node are the keys one level below it.  The session is an
+etcd lease kept alive while the store is open: ephemeral nodes are attached to
+the lease and deleted by etcd when it's revoked or expires.  Watches are etcd
+watches started at the revision read, so no change between the read and the
+watch is missed.
+*/
+type etcdStore struct {
+	client  *clientv3.Client
+	session *concurrency.Session
+	ctx     context.Context // Cancelled when the session ends, which ends every call and watch
+	cancel  context.CancelFunc
+	closing sync.Once
+}
+
+// Connect to a comma-separated list of etcd endpoints with a session timeout in seconds
+func ConnectEtcd(endpoints string, timeout int) (Store, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: time.Duration(timeout) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	grantCtx, grantCancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer grantCancel()
+	lease, err := client.Grant(grantCtx, int64(timeout))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	session, err := concurrency.NewSession(client, concurrency.WithLease(lease.ID))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &etcdStore{client: client, session: session, ctx: ctx, cancel: cancel}
+	go func() {
+		select {
+		case <-session.Done():
+			log.Error.Printf("etcd lease %x expired", lease.ID)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s, nil
+}
+
+// Translate an error from etcd, reporting any error after the session ends as ErrClosed
+func (s *etcdStore) error(err error) error {
+	if err != nil && s.ctx.Err() != nil {
+		return ErrClosed
+	}
+	return err
+}
+
+// Watch a node, or every key with its path as prefix, from a revision.  The watch fires with the
+// type of the first change for which the filter returns a non-empty type.
+func (s *etcdStore) watch(p string, prefix bool, rev int64, filter func(*clientv3.Event) string) <-chan Event {
+	events := make(chan Event, 1)
+	opts := []clientv3.OpOption{clientv3.WithRev(rev)}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	changes := s.client.Watch(ctx, p, opts...)
+	go func() {
+		defer cancel()
+		for resp := range changes {
+			if err := resp.Err(); err != nil {
+				events <- Event{Type: EVENT_SESSION, Path: p, Err: s.error(err)}
+				return
+			}
+			for _, evt := range resp.Events {
+				if eventType := filter(evt); eventType != "" {
+					if s.ctx.Err() != nil {
+						break // Don't report the deletion of ephemeral nodes as the session closes
+					}
+					events <- Event{Type: eventType, Path: p}
+					return
+				}
+			}
+		}
+		events <- Event{Type: EVENT_SESSION, Path: p, Err: ErrClosed}
+	}()
+	return events
+}
+
+// Report a change to the data of a node, or its deletion
+func dataChange(evt *clientv3.Event) string {
+	if evt.Type == clientv3.EventTypeDelete {
+		return EVENT_DELETED
+	}
+	return EVENT_DATA_CHANGED
+}
+
+// Report the creation of a node, a change to its data, or its deletion
+func existsChange(evt *clientv3.Event) string {
+	if evt.IsCreate() {
+		return EVENT_CREATED
+	}
+	return dataChange(evt)
+}
+
+// Return a filter reporting a child of a node being created or deleted, or the node itself being deleted
+func childrenChange(p string) func(*clientv3.Event) string {
+	return func(evt *clientv3.Event) string {
+		key := string(evt.Kv.Key)
+		if key == p && evt.Type == clientv3.EventTypeDelete {
+			return EVENT_DELETED
+		} else if key != p && path.Dir(key) == p && (evt.IsCreate() || evt.Type == clientv3.EventTypeDelete) {
+			return EVENT_CHILDREN_CHANGED
+		}
+		return ""
+	}
+}
+
+// Return the prefix of the keys of a node's descendants
+func childPrefix(p string) string {
+	if p == "/" {
+		return p
+	}
+	return p + "/"
+}
+
+func (s *etcdStore) Get(p string) ([]byte, error) {
+	b, _, err := s.get(p)
+	return b, err
+}
+
+// Get the data of a node and the revision at which it was read
+func (s *etcdStore) get(p string) ([]byte, int64, error) {
+	resp, err := s.client.Get(s.ctx, p)
+	if err != nil {
+		return nil, 0, s.error(err)
+	} else if len(resp.Kvs) == 0 {
+		return nil, 0, ErrNoNode
+	}
+	return resp.Kvs[0].Value, resp.Header.Revision, nil
+}
+
+func (s *etcdStore) GetW(p string) ([]byte, <-chan Event, error) {
+	b, rev, err := s.get(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, s.watch(p, false, rev+1, dataChange), nil
+}
+
+func (s *etcdStore) Set(p string, data []byte) error {
+	resp, err := s.client.Txn(s.ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(p), ">", 0)).
+		Then(clientv3.OpPut(p, string(data), clientv3.WithIgnoreLease())).
+		Commit()
+	if err != nil {
+		return s.error(err)
+	} else if !resp.Succeeded {
+		return ErrNoNode
+	}
+	return nil
+}
+
+func (s *etcdStore) Create(p string, data []byte, ephemeral bool) error {
+	parent := path.Dir(p)
+	if parent == p {
+		return ErrNodeExists
+	}
+	conditions := []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(p), "=", 0)}
+	if parent != "/" {
+		conditions = append(conditions, clientv3.Compare(clientv3.CreateRevision(parent), ">", 0))
+	}
+	opts := []clientv3.OpOption{}
+	if ephemeral {
+		opts = append(opts, clientv3.WithLease(s.session.Lease()))
+	}
+	resp, err := s.client.Txn(s.ctx).
+		If(conditions...).
+		Then(clientv3.OpPut(p, string(data), opts...)).
+		Else(clientv3.OpGet(p, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return s.error(err)
+	} else if resp.Succeeded {
+		return nil
+	} else if resp.Responses[0].GetResponseRange().Count > 0 {
+		return ErrNodeExists
+	}
+	return ErrNoNode
+}
+
+func (s *etcdStore) Delete(p string) error {
+	resp, err := s.client.Txn(s.ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(p), ">", 0),
+			clientv3.Compare(clientv3.CreateRevision(childPrefix(p)), "=", 0).WithPrefix()).
+		Then(clientv3.OpDelete(p)).
+		Else(clientv3.OpGet(p, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return s.error(err)
+	} else if resp.Succeeded {
+		return nil
+	} else if resp.Responses[0].GetResponseRange().Count > 0 {
+		return ErrNotEmpty
+	}
+	return ErrNoNode
+}
+
+func (s *etcdStore) Exists(p string) (bool, error) {
+	resp, err := s.client.Get(s.ctx, p, clientv3.WithCountOnly())
+	if err != nil {
+		return false, s.error(err)
+	}
+	return resp.Count > 0, nil
+}
+
+func (s *etcdStore) ExistsW(p string) (bool, <-chan Event, error) {
+	resp, err := s.client.Get(s.ctx, p, clientv3.WithCountOnly())
+	if err != nil {
+		return false, nil, s.error(err)
+	}
+	return resp.Count > 0, s.watch(p, false, resp.Header.Revision+1, existsChange), nil
+}
+
+func (s *etcdStore) Children(p string) ([]string, error) {
+	children, _, err := s.children(p)
+	return children, err
+}
+
+// Get the names of the children of a node, sorted, and the revision at which they were read
+func (s *etcdStore) children(p string) ([]string, int64, error) {
+	prefix := childPrefix(p)
+	resp, err := s.client.Txn(s.ctx).
+		Then(clientv3.OpGet(p, clientv3.WithCountOnly()),
+			clientv3.OpGet(prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())).
+		Commit()
+	if err != nil {
+		return nil, 0, s.error(err)
+	} else if p != "/" && resp.Responses[0].GetResponseRange().Count == 0 {
+		return nil, 0, ErrNoNode
+	}
+	children := []string{}
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		if name := strings.TrimPrefix(string(kv.Key), prefix); !strings.Contains(name, "/") {
+			children = append(children, name)
+		}
+	}
+	return children, resp.Header.Revision, nil
+}
+
+func (s *etcdStore) ChildrenW(p string) ([]string, <-chan Event, error) {
+	children, rev, err := s.children(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return children, s.watch(p, true, rev+1, childrenChange(p)), nil
+}
+
+// Return a lock implemented by etcd's mutex recipe, with keys under the node attached to this session's lease
+func (s *etcdStore) NewLock(p string) Locker {
+	return &etcdLock{store: s, mutex: concurrency.NewMutex(s.session, p)}
+}
+
+// A lock held by this session's key under the lock's node
+type etcdLock struct {
+	store *etcdStore
+	mutex *concurrency.Mutex
+}
+
+func (lock *etcdLock) Lock() error {
+	return lock.store.error(lock.mutex.Lock(lock.store.ctx))
+}
+
+func (lock *etcdLock) Unlock() error {
+	return lock.store.error(lock.mutex.Unlock(lock.store.ctx))
+}
+
+// End the session, firing its watches with ErrClosed before revoking its lease deletes its ephemeral nodes
+func (s *etcdStore) Close() {
+	s.closing.Do(func() {
+		s.cancel()
+		s.session.Close()
+		s.client.Close()
+	})
+}
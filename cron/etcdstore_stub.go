@@ -0,0 +1,13 @@
+//go:build !etcd
+// +build !etcd
+
+package cron
+
+import (
+	"fmt"
+)
+
+// Connect to etcd, which requires a build with the etcd tag and the etcd v3 client
+func ConnectEtcd(endpoints string, timeout int) (Store, error) {
+	return nil, fmt.Errorf("castle-cron was built without etcd support; rebuild it with -tags etcd as described in README.md to use %s%s", ETCD_SCHEME, endpoints)
+}
@@ -0,0 +1,78 @@
+//go:build etcd
+// +build etcd
+
+package cron
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Return a URL on a free local port
+func freeURL(t *testing.T) url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't find a free port: %s", err.Error())
+	}
+	defer listener.Close()
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// Start an etcd server in this process for the length of a test, returning its client endpoint
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Can't start etcd: %s", err.Error())
+	}
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("etcd didn't start")
+	}
+	return clientURL.Host
+}
+
+// Connect a new session to an etcd server, closing it when the test ends
+func connectEtcd(t *testing.T, endpoint string) Store {
+	s, err := ConnectEtcd(endpoint, 5)
+	if err != nil {
+		t.Fatalf("Can't connect to etcd: %s", err.Error())
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestEtcdStoreNodes(t *testing.T) {
+	testStoreNodes(t, connectEtcd(t, startEtcd(t)))
+}
+
+func TestEtcdStoreWatches(t *testing.T) {
+	testStoreWatches(t, connectEtcd(t, startEtcd(t)))
+}
+
+func TestEtcdStoreSessions(t *testing.T) {
+	endpoint := startEtcd(t)
+	testStoreSessions(t, connectEtcd(t, endpoint), func() Store { return connectEtcd(t, endpoint) })
+}
+
+func TestEtcdServerRunsJob(t *testing.T) {
+	s, err := ConnectStore(fmt.Sprintf("%s%s", ETCD_SCHEME, startEtcd(t)), 5)
+	if err != nil {
+		t.Fatalf("Can't connect to etcd: %s", err.Error())
+	}
+	useStore(t, s)
+	testServerRunsJob(t)
+}
@@ -0,0 +1,175 @@
+package cron
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+const (
+	DEFAULT_KILL_GRACE = 10 * time.Second // Default wait between SIGTERM and SIGKILL for a job that times out
+	DEFAULT_SHELL      = "/bin/sh"        // Default shell for jobs run in shell mode
+	MAX_STDIN          = 256 * 1024       // Maximum size of a job's standard input, which is stored in its znode
+)
+
+var (
+	KillGracePeriod = DEFAULT_KILL_GRACE // Wait between SIGTERM and SIGKILL for a job that times out
+)
+
+// Environment variables set for every run
+const (
+	ENV_JOB            = "CASTLE_CRON_JOB"            // Name of the job
+	ENV_SERVER         = "CASTLE_CRON_SERVER"         // Name of the server running the job
+	ENV_SCHEDULED_TIME = "CASTLE_CRON_SCHEDULED_TIME" // Time the run was scheduled for, in RFC 3339 format
+	ENV_RUN_ID         = "CASTLE_CRON_RUN_ID"         // Unique id of the run, as shown by the history command
+)
+
+// Return the script run by a job in shell mode: its command and arguments separated by blanks
+func (job *Job) Script() string {
+	return strings.Join(append([]string{job.Cmd}, job.Args...), " ")
+}
+
+// Build the command for a run with the job's shell, standard input, environment, working directory, and user
+func (job *Job) command() (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if job.Shell != "" {
+		cmd = exec.Command(job.Shell, "-c", job.Script())
+	} else {
+		cmd = exec.Command(job.Cmd, job.Args...)
+	}
+	if len(job.Stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(job.Stdin)
+	}
+	cmd.Dir = job.Dir
+	cmd.Env = os.Environ()
+	if job.User != "" || job.Group != "" {
+		credential, u, err := job.credential()
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		if u != nil {
+			cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+		}
+	}
+	names := make([]string, 0, len(job.Env))
+	for name := range job.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+job.Env[name])
+	}
+	cmd.Env = append(cmd.Env,
+		ENV_JOB+"="+job.Name,
+		ENV_SERVER+"="+serverName,
+		ENV_SCHEDULED_TIME+"="+job.NextRuntime.Format(time.RFC3339),
+		ENV_RUN_ID+"="+job.runID)
+	return cmd, nil
+}
+
+// Check that a job's environment variable names are valid and don't override those set for every run
+func (job *Job) validateEnv() error {
+	for name := range job.Env {
+		switch {
+		case name == "" || strings.ContainsAny(name, "=\x00"):
+			return fmt.Errorf("Invalid environment variable name \"%s\" for job %s", name, job.Name)
+		case strings.HasPrefix(name, "CASTLE_CRON_"):
+			return fmt.Errorf("Environment variable %s of job %s is reserved for castle-cron", name, job.Name)
+		}
+	}
+	return nil
+}
+
+// Look up the user and group a job runs as on this server
+func (job *Job) credential() (credential *syscall.Credential, u *user.User, e error) {
+	credential = &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if job.User != "" {
+		if u, e = user.Lookup(job.User); e != nil {
+			return nil, nil, fmt.Errorf("Unable to run job %s as user %s: %s", job.Name, job.User, e.Error())
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		credential.Uid, credential.Gid = uint32(uid), uint32(gid)
+	}
+	if job.Group != "" {
+		g, err := user.LookupGroup(job.Group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to run job %s as group %s: %s", job.Name, job.Group, err.Error())
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		credential.Gid = uint32(gid)
+	}
+	return
+}
+
+/*
+Run a command in its own process group and wait for it to complete.
+If timeout is nonzero and the command is still running when it expires,
+or if the stop channel is closed, send SIGTERM to the whole process group,
+followed by SIGKILL if it's still running after KillGracePeriod.
+Once the command exits, wait at most KillGracePeriod for its output to close,
+so that a process it leaves running outside its process group can't hold up
+the run.
+*/
+func runCommand(cmd *exec.Cmd, timeout time.Duration, stop <-chan struct{}) (timedOut, stopped bool, e error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.WaitDelay = KillGracePeriod
+	if e = cmd.Start(); e != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	select {
+	case e = <-done:
+		if errors.Is(e, exec.ErrWaitDelay) {
+			log.Warning.Printf("Process %d exited but its output was still open after %v; ignoring output from processes it left running",
+				cmd.Process.Pid, KillGracePeriod)
+			e = nil
+		}
+		return
+
+	case <-deadline:
+		timedOut = true
+		log.Trace.Printf("Stopping process group %d after timeout of %v", cmd.Process.Pid, timeout)
+
+	case <-stop:
+		stopped = true
+		log.Trace.Printf("Stopping process group %d on request", cmd.Process.Pid)
+	}
+	e = killProcessGroup(cmd.Process.Pid, done)
+	return
+}
+
+// Send SIGTERM to a process group, followed by SIGKILL if it hasn't completed after KillGracePeriod
+func killProcessGroup(pgid int, done <-chan error) error {
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case e := <-done:
+		return e
+	case <-time.After(KillGracePeriod):
+		log.Trace.Printf("Sending SIGKILL to process group %d after grace period of %v", pgid, KillGracePeriod)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		return <-done
+	}
+}
@@ -0,0 +1,86 @@
+package cron
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Use a short grace period between SIGTERM and SIGKILL for the rest of a test
+func useKillGracePeriod(t *testing.T, grace time.Duration) {
+	saved := KillGracePeriod
+	KillGracePeriod = grace
+	t.Cleanup(func() { KillGracePeriod = saved })
+}
+
+// Check whether a process is still running a second after it was sent a signal; a zombie has been
+// killed but not yet reaped by its parent
+func processRunning(pid int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return false
+		} else if fields := strings.Fields(string(b[strings.LastIndex(string(b), ")")+1:])); len(fields) == 0 || fields[0] == "Z" {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the process id a test command writes as its output
+func outputPid(t *testing.T, buffer *cappedBuffer) int {
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buffer.Bytes())))
+	if err != nil {
+		t.Fatalf("Command output %q isn't a process id", buffer.Bytes())
+	}
+	return pid
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	useKillGracePeriod(t, 200*time.Millisecond)
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"SIGTERM", "sleep 30 & echo $!; wait"},
+		{"SIGKILL", "trap '' TERM; sleep 30 & echo $!; wait"},
+	}
+	for _, test := range tests {
+		buffer := &cappedBuffer{max: MaxOutputSize}
+		cmd := exec.Command(DEFAULT_SHELL, "-c", test.script)
+		cmd.Stdout = buffer
+		start := time.Now()
+		timedOut, stopped, err := runCommand(cmd, 200*time.Millisecond, nil)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: command took %v to stop", test.name, elapsed)
+		}
+		if !timedOut || stopped || err == nil {
+			t.Errorf("%s: command returned timedOut %v, stopped %v, error %v; expected a timeout", test.name, timedOut, stopped, err)
+		}
+		if pid := outputPid(t, buffer); processRunning(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("%s: child process %d still running after timeout", test.name, pid)
+		}
+	}
+}
+
+func TestRunCommandLeavesProcess(t *testing.T) {
+	useKillGracePeriod(t, 200*time.Millisecond)
+	buffer := &cappedBuffer{max: MaxOutputSize}
+	cmd := exec.Command(DEFAULT_SHELL, "-c", "setsid sleep 30 & echo $!")
+	cmd.Stdout = buffer
+	start := time.Now()
+	timedOut, stopped, err := runCommand(cmd, 0, nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Command waited %v for the process it left running", elapsed)
+	}
+	if timedOut || stopped || err != nil {
+		t.Errorf("Command returned timedOut %v, stopped %v, error %v; expected success", timedOut, stopped, err)
+	}
+	syscall.Kill(outputPid(t, buffer), syscall.SIGKILL)
+}
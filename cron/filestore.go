@@ -0,0 +1,592 @@
+package cron
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Interval at which a file store session checks for changes made by other sessions
+var FilePollInterval = 100 * time.Millisecond
+
+// Files and directories of a file store, directly under its directory
+const (
+	FILE_LOCK     = ".lock"     // File locked while the tree is read (shared) or changed (exclusive)
+	FILE_SEQ      = ".seq"      // File holding the sequence number of the last change to the tree
+	FILE_SESSIONS = ".sessions" // Directory of one file per open session, locked by the session
+	FILE_LOCKS    = ".locks"    // Directory of one file per Locker, locked by its holder
+	FILE_TREE     = "tree"      // Directory holding the root node
+	FILE_DATA     = ".data"     // File in each node's directory holding its sequence number and data
+	FILE_OWNER    = ".owner"    // File in an ephemeral node's directory naming the session that created it
+)
+
+/*
+A FileStore is a Store held in a directory on local disk, so that a server and
+the CLI on one host can share a schedule without a coordination service.  Each
+node is a directory under the tree directory holding its data, and each child
+is a subdirectory.  Processes cooperate with flock: every operation holds a
+lock on the store's lock file, each open session holds a lock on its own file
+for as long as it's open, and each Locker is a lock on a file of its own.  A
+session that finds another session's file unlocked knows that session has
+ended, and deletes its ephemeral nodes.  Watches are checked by each session
+whenever the sequence number of the last change to the tree moves on.
+*/
+type FileStore struct {
+	dir     string
+	id      string   // Session id, naming its file in the sessions directory
+	session *os.File // Session file, locked while the session is open
+	mutex   sync.Mutex
+	watches []*fileWatch // Watches set by this session that haven't fired
+	locks   []*fileLock  // Lockers of this session, released when it ends
+	closed  bool
+	done    chan struct{} // Closed when the session ends
+}
+
+// Kinds of watch on a node
+const (
+	watchData = iota
+	watchExists
+	watchChildren
+)
+
+// A watch set on a node, with the state of the node when it was set
+type fileWatch struct {
+	path     string
+	kind     int
+	exists   bool
+	seq      uint64
+	children []string
+	events   chan Event
+}
+
+// Open a session on the file store in a directory, creating the directory if necessary
+func OpenFileStore(dir string) (*FileStore, error) {
+	for _, d := range []string{dir, filepath.Join(dir, FILE_SESSIONS), filepath.Join(dir, FILE_LOCKS), filepath.Join(dir, FILE_TREE)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &FileStore{dir: dir, id: fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()), done: make(chan struct{})}
+	err := s.withLock(true, func() error {
+		if _, err := os.Stat(filepath.Join(dir, FILE_TREE, FILE_DATA)); os.IsNotExist(err) {
+			if err = writeNodeData(filepath.Join(dir, FILE_TREE), nil, 0); err != nil {
+				return err
+			}
+		}
+		file, err := os.OpenFile(filepath.Join(dir, FILE_SESSIONS, s.id), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		} else if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			return err
+		}
+		s.session = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sweep(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.poll(s.lastSeq())
+	return s, nil
+}
+
+// Check that this session hasn't been closed
+func (s *FileStore) check() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Call a function holding a shared lock on the tree, or an exclusive lock if it changes the tree
+func (s *FileStore) withLock(exclusive bool, f func() error) error {
+	file, err := os.OpenFile(filepath.Join(s.dir, FILE_LOCK), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err = syscall.Flock(int(file.Fd()), how); err != nil {
+		return err
+	}
+	return f()
+}
+
+// Return the sequence number of the last change to the tree
+func (s *FileStore) lastSeq() uint64 {
+	b, _ := os.ReadFile(filepath.Join(s.dir, FILE_SEQ))
+	seq, _ := strconv.ParseUint(string(b), 10, 64)
+	return seq
+}
+
+// Record a change to the tree, returning its sequence number.  The caller must hold the exclusive lock.
+func (s *FileStore) nextSeq() (uint64, error) {
+	seq := s.lastSeq() + 1
+	return seq, writeFile(filepath.Join(s.dir, FILE_SEQ), []byte(strconv.FormatUint(seq, 10)))
+}
+
+// Replace a file by renaming a new file over it, so readers see either the old or the new content
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Write the data of the node in a directory with the sequence number of the change
+func writeNodeData(dir string, data []byte, seq uint64) error {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(b, seq)
+	return writeFile(filepath.Join(dir, FILE_DATA), append(b, data...))
+}
+
+// Return the directory name of a node name, escaped so it can't be mistaken for one of the store's files
+func escapeName(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+// Return the directory of a node
+func (s *FileStore) nodeDir(p string) string {
+	dir := filepath.Join(s.dir, FILE_TREE)
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name != "" {
+			dir = filepath.Join(dir, escapeName(name))
+		}
+	}
+	return dir
+}
+
+// Read the data of a node and the sequence number of the change that set it.  The caller must hold the lock.
+func (s *FileStore) readNode(p string) ([]byte, uint64, error) {
+	b, err := os.ReadFile(filepath.Join(s.nodeDir(p), FILE_DATA))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNoNode
+	} else if err != nil {
+		return nil, 0, err
+	} else if len(b) < 8 {
+		return nil, 0, fmt.Errorf("Data of node %s is corrupt", p)
+	}
+	return b[8:], binary.BigEndian.Uint64(b), nil
+}
+
+// Return the names of a node's children, sorted.  The caller must hold the lock.
+func (s *FileStore) readChildren(p string) ([]string, error) {
+	entries, err := os.ReadDir(s.nodeDir(p))
+	if os.IsNotExist(err) {
+		return nil, ErrNoNode
+	} else if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			if name, err := url.PathUnescape(entry.Name()); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete a node that has no children.  The caller must hold the exclusive lock.
+func (s *FileStore) deleteNode(p string) error {
+	if strings.Trim(p, "/") == "" {
+		return ErrNoNode
+	} else if children, err := s.readChildren(p); err != nil {
+		return err
+	} else if len(children) > 0 {
+		return ErrNotEmpty
+	}
+	dir := s.nodeDir(p)
+	if _, err := os.Stat(filepath.Join(dir, FILE_DATA)); err != nil {
+		return ErrNoNode
+	}
+	trash := filepath.Join(filepath.Dir(dir), ".deleted-"+s.id)
+	if err := os.Rename(dir, trash); err != nil {
+		return err
+	}
+	return os.RemoveAll(trash)
+}
+
+// Set a watch on a node with its current state.  The caller must hold the lock.
+func (s *FileStore) watch(p string, kind int) (<-chan Event, error) {
+	w := &fileWatch{path: p, kind: kind, events: make(chan Event, 1)}
+	if err := s.readWatched(w); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.watches = append(s.watches, w)
+	return w.events, nil
+}
+
+// Read the current state of a watched node into a watch.  The caller must hold the lock.
+func (s *FileStore) readWatched(w *fileWatch) (err error) {
+	_, w.seq, err = s.readNode(w.path)
+	w.exists = err == nil
+	if err == ErrNoNode {
+		err = nil
+	}
+	if w.exists && w.kind == watchChildren {
+		w.children, err = s.readChildren(w.path)
+	}
+	return err
+}
+
+// Return the type of change to a watched node, or an empty string if it hasn't changed.  The caller must hold the lock.
+func (s *FileStore) changed(w *fileWatch) string {
+	now := &fileWatch{path: w.path, kind: w.kind}
+	if err := s.readWatched(now); err != nil {
+		return ""
+	}
+	switch {
+	case w.exists && !now.exists:
+		return EVENT_DELETED
+	case !w.exists && now.exists:
+		return EVENT_CREATED
+	case w.kind == watchChildren && strings.Join(w.children, "/") != strings.Join(now.children, "/"):
+		return EVENT_CHILDREN_CHANGED
+	case w.kind != watchChildren && w.exists && w.seq != now.seq:
+		return EVENT_DATA_CHANGED
+	}
+	return ""
+}
+
+// Fire this session's watches on nodes that have changed.  The caller must hold the lock.
+func (s *FileStore) fireWatches() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	remaining := []*fileWatch{}
+	for _, w := range s.watches {
+		if eventType := s.changed(w); eventType != "" {
+			w.events <- Event{Type: eventType, Path: w.path}
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	s.watches = remaining
+}
+
+// Check for changes to the tree since a change and for ended sessions until this session ends
+func (s *FileStore) poll(seq uint64) {
+	ticker := time.NewTicker(FilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.sweep()
+		if latest := s.lastSeq(); latest != seq {
+			seq = latest
+			s.withLock(false, func() error {
+				s.fireWatches()
+				return nil
+			})
+		}
+	}
+}
+
+// Return the ids of other sessions whose files aren't locked, meaning they've ended
+func (s *FileStore) endedSessions() []string {
+	entries, _ := os.ReadDir(filepath.Join(s.dir, FILE_SESSIONS))
+	ended := []string{}
+	for _, entry := range entries {
+		if id := entry.Name(); id != s.id {
+			if file, err := os.Open(filepath.Join(s.dir, FILE_SESSIONS, id)); err == nil {
+				if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+					ended = append(ended, id)
+				}
+				file.Close()
+			}
+		}
+	}
+	return ended
+}
+
+// Delete the ephemeral nodes of sessions that have ended
+func (s *FileStore) sweep() error {
+	ended := s.endedSessions()
+	if len(ended) == 0 {
+		return nil
+	}
+	return s.withLock(true, func() error {
+		for _, id := range s.endedSessions() {
+			if err := s.deleteEphemeral(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete the ephemeral nodes of a session and its file.  The caller must hold the exclusive lock.
+func (s *FileStore) deleteEphemeral(id string) error {
+	name := filepath.Join(s.dir, FILE_SESSIONS, id)
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	deleted := false
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		p := scanner.Text()
+		if owner, err := os.ReadFile(filepath.Join(s.nodeDir(p), FILE_OWNER)); err == nil && string(owner) == id {
+			if err = s.deleteNode(p); err == nil {
+				deleted = true
+			}
+		}
+	}
+	if deleted {
+		if _, err = s.nextSeq(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(name)
+}
+
+func (s *FileStore) Get(p string) (b []byte, err error) {
+	if err = s.check(); err != nil {
+		return nil, err
+	}
+	err = s.withLock(false, func() error {
+		b, _, err = s.readNode(p)
+		return err
+	})
+	return b, err
+}
+
+func (s *FileStore) GetW(p string) (b []byte, watch <-chan Event, err error) {
+	if err = s.check(); err != nil {
+		return nil, nil, err
+	}
+	err = s.withLock(false, func() error {
+		if b, _, err = s.readNode(p); err == nil {
+			watch, err = s.watch(p, watchData)
+		}
+		return err
+	})
+	return b, watch, err
+}
+
+func (s *FileStore) Set(p string, data []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.withLock(true, func() error {
+		if _, _, err := s.readNode(p); err != nil {
+			return err
+		} else if seq, err := s.nextSeq(); err != nil {
+			return err
+		} else {
+			return writeNodeData(s.nodeDir(p), data, seq)
+		}
+	})
+}
+
+func (s *FileStore) Create(p string, data []byte, ephemeral bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.withLock(true, func() error {
+		parentPath, name := path.Split(p)
+		parentPath = path.Clean(parentPath)
+		if _, _, err := s.readNode(p); err != ErrNoNode {
+			if err == nil {
+				return ErrNodeExists
+			}
+			return err
+		} else if _, _, err = s.readNode(parentPath); err != nil || name == "" {
+			return ErrNoNode
+		}
+		seq, err := s.nextSeq()
+		if err != nil {
+			return err
+		}
+
+		// Build the node in a temporary directory and rename it into place, so it appears complete
+		tmp := filepath.Join(s.nodeDir(parentPath), ".new-"+s.id)
+		os.RemoveAll(tmp)
+		if err = os.Mkdir(tmp, 0755); err != nil {
+			return err
+		} else if err = writeNodeData(tmp, data, seq); err != nil {
+			return err
+		}
+		if ephemeral {
+			if err = os.WriteFile(filepath.Join(tmp, FILE_OWNER), []byte(s.id), 0644); err != nil {
+				return err
+			} else if _, err = fmt.Fprintln(s.session, p); err != nil {
+				return err
+			}
+		}
+		return os.Rename(tmp, s.nodeDir(p))
+	})
+}
+
+func (s *FileStore) Delete(p string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.withLock(true, func() error {
+		if err := s.deleteNode(p); err != nil {
+			return err
+		}
+		_, err := s.nextSeq()
+		return err
+	})
+}
+
+func (s *FileStore) Exists(p string) (exists bool, err error) {
+	if err = s.check(); err != nil {
+		return false, err
+	}
+	err = s.withLock(false, func() error {
+		_, _, err := s.readNode(p)
+		exists = err == nil
+		if err == ErrNoNode {
+			return nil
+		}
+		return err
+	})
+	return exists, err
+}
+
+func (s *FileStore) ExistsW(p string) (exists bool, watch <-chan Event, err error) {
+	if err = s.check(); err != nil {
+		return false, nil, err
+	}
+	err = s.withLock(false, func() error {
+		if _, _, err = s.readNode(p); err == nil || err == ErrNoNode {
+			exists = err == nil
+			watch, err = s.watch(p, watchExists)
+		}
+		return err
+	})
+	return exists, watch, err
+}
+
+func (s *FileStore) Children(p string) (children []string, err error) {
+	if err = s.check(); err != nil {
+		return nil, err
+	}
+	err = s.withLock(false, func() error {
+		children, err = s.readChildren(p)
+		return err
+	})
+	return children, err
+}
+
+func (s *FileStore) ChildrenW(p string) (children []string, watch <-chan Event, err error) {
+	if err = s.check(); err != nil {
+		return nil, nil, err
+	}
+	err = s.withLock(false, func() error {
+		if children, err = s.readChildren(p); err == nil {
+			watch, err = s.watch(p, watchChildren)
+		}
+		return err
+	})
+	return children, watch, err
+}
+
+// Return a lock on a file of its own, shared by every session of every process using the directory
+func (s *FileStore) NewLock(p string) Locker {
+	lock := &fileLock{name: filepath.Join(s.dir, FILE_LOCKS, url.PathEscape(p)), session: s}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.locks = append(s.locks, lock)
+	return lock
+}
+
+// A lock held by whoever holds a flock on its file
+type fileLock struct {
+	name    string
+	session *FileStore
+	mutex   sync.Mutex
+	file    *os.File // Locked file while the lock is held
+}
+
+func (lock *fileLock) Lock() error {
+	if err := lock.session.check(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(lock.name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	} else if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return err
+	}
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if err = lock.session.check(); err != nil {
+		file.Close() // Closed while waiting, so Close() didn't release it
+		return err
+	}
+	lock.file = file
+	return nil
+}
+
+func (lock *fileLock) Unlock() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.file == nil {
+		return ErrNoNode
+	}
+	err := lock.file.Close()
+	lock.file = nil
+	return err
+}
+
+// End the session, firing its remaining watches with ErrClosed before deleting its ephemeral nodes
+// and releasing its locks
+func (s *FileStore) Close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	for _, w := range s.watches {
+		w.events <- Event{Type: EVENT_SESSION, Path: w.path, Err: ErrClosed}
+	}
+	s.watches = nil
+	locks := s.locks
+	s.locks = nil
+	s.mutex.Unlock()
+
+	s.withLock(true, func() error {
+		return s.deleteEphemeral(s.id)
+	})
+	for _, lock := range locks {
+		lock.Unlock()
+	}
+	s.session.Close()
+}
@@ -0,0 +1,88 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+// Open a session on a file store, closing it when the test ends
+func openFileStore(t *testing.T, dir string) *FileStore {
+	s, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("Can't open file store: %s", err.Error())
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestFileStoreNodes(t *testing.T) {
+	testStoreNodes(t, openFileStore(t, t.TempDir()))
+}
+
+func TestFileStoreWatches(t *testing.T) {
+	testStoreWatches(t, openFileStore(t, t.TempDir()))
+}
+
+func TestFileStoreSessions(t *testing.T) {
+	dir := t.TempDir()
+	testStoreSessions(t, openFileStore(t, dir), func() Store { return openFileStore(t, dir) })
+}
+
+func TestFileStoreCloseReleasesLock(t *testing.T) {
+	dir := t.TempDir()
+	holder, other := openFileStore(t, dir), openFileStore(t, dir)
+	lock := holder.NewLock(PATH_JOBLOCK)
+	if err := lock.Lock(); err != nil {
+		t.Fatalf("Can't take lock: %s", err.Error())
+	}
+	locked := make(chan error)
+	go func() {
+		lock := other.NewLock(PATH_JOBLOCK)
+		err := lock.Lock()
+		locked <- err
+		if err == nil {
+			lock.Unlock()
+		}
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Lock taken by two sessions")
+	case <-time.After(50 * time.Millisecond):
+	}
+	holder.Close()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Errorf("Can't take lock released by closed session: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Lock of closed session not released")
+	}
+	if err := lock.Lock(); err != ErrClosed {
+		t.Errorf("Closed session took lock: %v", err)
+	}
+}
+
+func TestFileStoreNames(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	s.Create("/a", nil, false)
+	for _, name := range []string{".data", "..", "x%2Ey", "a b"} {
+		if err := s.Create("/a/"+name, []byte(name), false); err != nil {
+			t.Errorf("Create %s: %s", name, err.Error())
+		} else if b, err := s.Get("/a/" + name); err != nil || string(b) != name {
+			t.Errorf("Get %s: %s %v", name, b, err)
+		}
+	}
+	if children, err := s.Children("/a"); err != nil || len(children) != 4 || children[0] != ".." || children[1] != ".data" {
+		t.Errorf("Children of /a: %v %v", children, err)
+	}
+}
+
+func TestFileServerRunsJob(t *testing.T) {
+	s, err := ConnectStore(FILE_SCHEME+t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("Can't open file store: %s", err.Error())
+	}
+	useStore(t, s)
+	testServerRunsJob(t)
+}
@@ -0,0 +1,157 @@
+package cron
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+const (
+	DEFAULT_HISTORY_RUNS = 100 // Default number of runs kept in each job's history
+)
+
+var (
+	HistoryRunsKept = DEFAULT_HISTORY_RUNS // Number of runs kept in /history/<jobname>; 0 => no limit
+	HistoryMaxAge   time.Duration          // Maximum age of runs kept in /history/<jobname>; 0 => no limit
+)
+
+// Record of a single run of a job, stored in znode /history/<jobname>/<runid>
+type RunRecord struct {
+	RunID    string    // Unique id of this run
+	Server   string    // Name of server that ran the job
+	Start    time.Time // Time job started
+	End      time.Time // Time job ended
+	Attempt  int       // Retry number; 0 => regular scheduled run
+	AdHoc    bool      // Run was requested by the run command or a dependency rather than the schedule
+	After    string    // Job whose run triggered this run through a dependency
+	ExitCode int       // Exit code of the command; -1 if it could not be started
+	TimedOut bool      // Command was killed because it exceeded the job's timeout
+	Err      string    // Error returned by the command, if any
+}
+
+// Return the exit code of a command that has run
+func exitCode(cmd *exec.Cmd, err error) int {
+	if cmd == nil || cmd.ProcessState == nil {
+		return -1
+	} else if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	} else if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// Return a run's duration in seconds
+func (record *RunRecord) Seconds() float64 {
+	return record.End.Sub(record.Start).Seconds()
+}
+
+// Save a run in znode /history/<jobname>/<runid> and discard runs too old or too many to keep
+func (job *Job) saveHistory(record *RunRecord) error {
+	jobPath := fmt.Sprintf("%s/%s", PATH_HISTORY, job.Name)
+	if b, err := gobEncode(record); err != nil {
+		return fmt.Errorf("Unable to serialize history of job %s: %s", job.Name, err.Error())
+	} else if err = ensurePath(jobPath); err != nil {
+		return err
+	} else if err = store.Create(fmt.Sprintf("%s/%s", jobPath, record.RunID), b, false); err != nil {
+		return fmt.Errorf("Unable to save history of job %s: %s", job.Name, err.Error())
+	}
+	return trimHistory(job.Name)
+}
+
+// Discard the runs in a job's history that exceed HistoryRunsKept or HistoryMaxAge
+func trimHistory(name string) error {
+	jobPath := fmt.Sprintf("%s/%s", PATH_HISTORY, name)
+	runs, err := store.Children(jobPath)
+	if err == ErrNoNode {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to list history of job %s: %s", name, err.Error())
+	}
+	sort.Strings(runs)
+	discard := 0
+	if HistoryRunsKept > 0 && len(runs) > HistoryRunsKept {
+		discard = len(runs) - HistoryRunsKept
+	}
+	if HistoryMaxAge > 0 {
+		oldest := time.Now().Add(-HistoryMaxAge)
+		for discard < len(runs) && runIDTime(runs[discard]).Before(oldest) {
+			discard++
+		}
+	}
+	for _, run := range runs[:discard] {
+		if err = store.Delete(fmt.Sprintf("%s/%s", jobPath, run)); err != nil && err != ErrNoNode {
+			log.Warning.Printf("Unable to delete old history %s of job %s: %s", run, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Get the history of the last n runs of a job, most recent first.  n <= 0 returns the full history.
+func ListHistory(name string, n int) (records []*RunRecord, e error) {
+	jobPath := fmt.Sprintf("%s/%s", PATH_HISTORY, name)
+	runs, err := store.Children(jobPath)
+	if err == ErrNoNode {
+		return []*RunRecord{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to list history of job %s: %s", name, err.Error())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runs)))
+	if n > 0 && len(runs) > n {
+		runs = runs[:n]
+	}
+	records = []*RunRecord{}
+	for _, run := range runs {
+		record := &RunRecord{}
+		if b, err := store.Get(fmt.Sprintf("%s/%s", jobPath, run)); err == ErrNoNode {
+			continue // Discarded since we listed the runs
+		} else if err != nil {
+			return nil, fmt.Errorf("Can't fetch history %s of job %s: %s", run, name, err.Error())
+		} else if err = gobDecode(b, record); err != nil {
+			return nil, fmt.Errorf("Unable to decode history %s of job %s: %s", run, name, err.Error())
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// Wait up to a timeout for a run of a job to complete and return its history.  A timeout <= 0 waits indefinitely.
+func WaitForRun(name, runID string, timeout time.Duration) (*RunRecord, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	runPath := fmt.Sprintf("%s/%s/%s", PATH_HISTORY, name, runID)
+	for {
+		if err := ensurePath(fmt.Sprintf("%s/%s", PATH_HISTORY, name)); err != nil {
+			return nil, err
+		}
+		exists, watch, err := store.ExistsW(runPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to wait for run %s of job %s: %s", runID, name, err.Error())
+		} else if exists {
+			record := &RunRecord{}
+			if b, err := store.Get(runPath); err != nil {
+				return nil, fmt.Errorf("Can't fetch history %s of job %s: %s", runID, name, err.Error())
+			} else if err = gobDecode(b, record); err != nil {
+				return nil, fmt.Errorf("Unable to decode history %s of job %s: %s", runID, name, err.Error())
+			}
+			return record, nil
+		}
+		select {
+		case evt := <-watch:
+			if evt.Err != nil {
+				return nil, fmt.Errorf("Error waiting for run %s of job %s: %s", runID, name, evt.Err.Error())
+			}
+		case <-expired:
+			return nil, fmt.Errorf("Timed out waiting for run %s of job %s", runID, name)
+		}
+	}
+}
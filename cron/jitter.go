@@ -0,0 +1,63 @@
+package cron
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Jitter modes, which determine how a job's runs are offset within its jitter window
+const (
+	JITTER_HASH   = "hash"   // Offset by a fixed amount derived from the job's name (the default)
+	JITTER_RANDOM = "random" // Offset by a random amount chosen each time the job is scheduled
+	JITTER_NONE   = "none"   // Don't offset the job, even if the cluster has a default jitter
+)
+
+// Check that a jitter mode is valid
+func validJitterMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", JITTER_HASH, JITTER_RANDOM, JITTER_NONE:
+		return true
+	}
+	return false
+}
+
+/*
+Return the offset added to a job's scheduled time so jobs scheduled at the same
+time don't all become due at once.  The job's jitter window and mode default to
+the cluster's.  Validate() keeps a job's own window within the time between its
+runs, but the cluster's can be wider, so an inherited window is cut down to it.
+In hash mode, the offset is the same for every run of the job and on every
+server, so the job's effective time is stable.
+*/
+func (job *Job) jitterOffset() time.Duration {
+	window, mode := job.Jitter, strings.ToLower(job.JitterMode)
+	if window == 0 || mode == "" {
+		if config, err := GetConfig(); err != nil {
+			log.Warning.Println(err.Error())
+		} else {
+			if window == 0 && config.Jitter > 0 {
+				window = config.Jitter
+				if period, err := job.period(); err != nil {
+					log.Warning.Printf("Unable to limit default jitter of job %s: %s", job.Name, err.Error())
+				} else if period > 0 && window > period {
+					window = period
+				}
+			}
+			if mode == "" {
+				mode = strings.ToLower(config.JitterMode)
+			}
+		}
+	}
+	if window <= 0 || mode == JITTER_NONE {
+		return 0
+	} else if mode == JITTER_RANDOM {
+		return time.Duration(rand.Int63n(int64(window)))
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(job.Name))
+	return time.Duration(hash.Sum64() % uint64(window))
+}
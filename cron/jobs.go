@@ -5,27 +5,70 @@ import (
 	"strings"
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
-	"os/exec"
 	"sort"
 	"time"
 
-	"github.com/gorhill/cronexpr"
-	"github.com/samuel/go-zookeeper/zk"
 	log "github.com/tooda02/castle-cron/logging"
 )
 
 const (
-	NULL_JOBNAME = "(null)"
+	NULL_JOBNAME       = "(null)"
+	JOB_SCHEMA_VERSION = 1 // Version of the JSON envelope written by Serialize
 )
 
+// The envelope of a serialized job, identifying the version of its schema
+type jobEnvelope struct {
+	Version int  `json:"version"`
+	Job     *Job `json:"job"`
+}
+
 type Job struct {
-	Name        string    // Name of this job
-	Cmd         string    // Command to run
-	Args        []string  // Command arguments
-	HasError    bool      // Job has an error - do not run
-	NextRuntime time.Time // Time of next execution
-	Schedule    string    // cron-type schedule string - see below
+	Name             string            // Name of this job
+	Cmd              string            // Command to run
+	Args             []string          // Command arguments
+	Timeout          time.Duration     // Maximum run time before the job is killed; 0 => no limit
+	Concurrency      string            // Policy when a previous run is still active: allow, forbid, or replace
+	Orphans          string            // Policy when a run's server stops while it's running: fail or rerun
+	MaxRetries       int               // Number of times to retry a failed run before its next scheduled run
+	RetryDelay       time.Duration     // Wait before the first retry; doubles with each further retry
+	RetryMaxDelay    time.Duration     // Maximum wait before a retry; 0 => no limit
+	Attempt          int               // Retry number of the pending run; 0 => regular scheduled run
+	LastServer       string            // Server where the run being retried failed
+	Shell            string            // Shell that runs Cmd and Args as a script; "" => run Cmd directly
+	Stdin            []byte            // Data written to the command's standard input
+	Env              map[string]string // Environment variables added to the server's environment
+	Dir              string            // Working directory; "" => server's working directory
+	User             string            // Unix user to run the command as; "" => server's user
+	Group            string            // Unix group to run the command as; "" => User's primary group
+	Misfire          string            // Policy when the job is found past its misfire threshold: once, skip, or all
+	MisfireThreshold time.Duration     // Lateness beyond which a run counts as missed; 0 => DEFAULT_MISFIRE_THRESHOLD
+	MisfireLimit     int               // Maximum missed runs caught up by the "all" policy; 0 => DEFAULT_MISFIRE_LIMIT
+	CatchUp          int               // Number of missed runs remaining to catch up, including the pending one
+	HasError         bool              // Job has an error - do not run
+	Paused           bool              // Job is paused by the pause command - do not run until resumed
+	AdHoc            string            // Run id of an ad-hoc run queued by the run command or a dependency; empty for the job itself
+	TriggeredBy      string            // Job whose run triggered an ad-hoc run through a dependency
+	AfterSuccess     []string          // Jobs whose successful runs trigger a run of this job
+	AfterAny         []string          // Jobs whose runs trigger a run of this job whether they succeed or fail
+	Selector         string            // Labels a server must have to run the job, e.g. zone=east,role!=db; "" => any server
+	Servers          []string          // Names of the servers that can run the job, which can contain wildcards; empty => any server
+	Placement        string            // How the server that runs the job is chosen: random, round-robin, least-running, or race; "" => cluster default
+	Broadcast        bool              // Run on every server that can run the job rather than on one of them
+	Deadline         time.Duration     // How long a broadcast run waits for every server to report; 0 => DEFAULT_BROADCAST_DEADLINE
+	BroadcastTick    time.Time         // Scheduled time of the broadcast run in progress, while NextRuntime is its deadline
+	PlacedOn         string            // Server that ran the job's last scheduled run
+	NextRuntime      time.Time         // Time of next execution, including any jitter; zero once a one-shot job has run
+	BaseRuntime      time.Time         // Time of next execution called for by the schedule, before jitter
+	Jitter           time.Duration     // Window within which runs are offset from the schedule; 0 => cluster default
+	JitterMode       string            // How runs are offset within the jitter window: hash, random, or none; "" => cluster default
+	At               time.Time         // Time of a one-shot job's only run; zero => run on Schedule
+	Retain           time.Duration     // How long a one-shot job is archived after its run; 0 => delete it
+	Retired          time.Time         // Time a one-shot job was archived
+	Anchor           time.Time         // Start of the intervals of an @every schedule
+	TZ               string            // IANA time zone of the schedule, e.g. America/New_York; "" => server's local zone
+	Schedule         string            // cron-type schedule string, optionally prefixed by CRON_TZ=<zone> - see below
 	/*
 		Field name     Mandatory?   Allowed values    Allowed special characters
 		----------     ----------   --------------    --------------------------
@@ -39,100 +82,349 @@ type Job struct {
 
 		From https://github.com/gorhill/cronexpr
 	*/
+
+	runID    string    // Id of the run started by prepareRun() (not serialized)
+	runStart time.Time // Start time of the run started by prepareRun() (not serialized)
+}
+
+// Error returned by Deserialize when data can't be decoded as a job
+type DecodeError struct {
+	Err error // Error from the decoder, or describing what's missing from the decoded job
 }
 
-// Deserialize a byte array into a Job struct
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to deserialize job: %s", e.Err.Error())
+}
+
+// Deserialize a byte array into a Job struct, whether a JSON envelope or legacy gob encoding.
+// Empty data, as /nextjob holds when no job is scheduled, is a null job that's never due.
 func Deserialize(b []byte) (job *Job, e error) {
 	job = &Job{}
 	if b == nil || len(b) == 0 {
 		// Ensure null job isn't scheduled
 		job.Name = NULL_JOBNAME
 		job.NextRuntime = time.Now().Add(time.Duration(24) * time.Hour)
+		return
+	} else if !IsLegacyJob(b) {
+		envelope := jobEnvelope{Job: job}
+		if err := json.Unmarshal(b, &envelope); err != nil {
+			return nil, &DecodeError{Err: err}
+		} else if envelope.Version > JOB_SCHEMA_VERSION {
+			log.Warning.Printf("Job %s has schema version %d, newer than version %d known to this release; fields added since are ignored",
+				job.Name, envelope.Version, JOB_SCHEMA_VERSION)
+		}
 	} else {
 		buffer := bytes.NewBuffer(b)
 		decoder := gob.NewDecoder(buffer)
 		if err := decoder.Decode(&job); err != nil {
-			log.Error.LogStackTrace(fmt.Sprintf("Unable to deserialize job: %s", err.Error()), true, 10)
-			job = &Job{}
-			job.Name = NULL_JOBNAME
-			job.NextRuntime = time.Now().Add(time.Duration(24) * time.Hour)
+			return nil, &DecodeError{Err: err}
 		}
 	}
+	if job.Name == "" {
+		return nil, &DecodeError{Err: fmt.Errorf("job has no name")}
+	}
 	return
 }
 
-// Get a job or a list of jobs from Zookeeper
+// Get a job or a list of jobs from Zookeeper.  Jobs that can't be decoded are skipped and reported,
+// leaving them for the server or the doctor command to quarantine.
 func ListJobs(name string) (jobs []*Job, e error) {
 	jobs = []*Job{}
-	jobnames := []string{name}
+	jobnames, err := matchJobnames(PATH_JOBS, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, jobname := range jobnames {
+		znode := fmt.Sprintf("%s/%s", PATH_JOBS, jobname)
+		if b, err := store.Get(znode); err != nil {
+			return nil, fmt.Errorf("Can't fetch job %s: %s", jobname, err.Error())
+		} else if job, err := Deserialize(b); err != nil {
+			skipUndecodable(znode, err)
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+	return
+}
+
+// Get a single job for the server.  Unlike ListJobs(), a job that can't be decoded is an error,
+// and it's quarantined so that the server carries on as if the job had been deleted.
+func getJob(name string) (*Job, error) {
+	znode := fmt.Sprintf("%s/%s", PATH_JOBS, name)
+	b, err := store.Get(znode)
+	if err != nil {
+		return nil, fmt.Errorf("Can't fetch job %s: %s", name, err.Error())
+	}
+	job, err := Deserialize(b)
+	if err != nil {
+		if qerr := quarantine(znode, b, err); qerr != nil {
+			log.Error.Println(qerr.Error())
+		}
+		return nil, fmt.Errorf("Job %s can't be decoded: %s", name, err.Error())
+	}
+	return job, nil
+}
+
+// Get the job names under a root znode that match a name, which can be empty
+// to match all jobs or contain "*" as a wildcard
+func matchJobnames(root, name string) (jobnames []string, e error) {
 	var rxJobnames *regexp.Regexp
 	if strings.Index(name, "*") != -1 {
 		if rxJobnames, e = regexp.Compile(strings.Replace(name, "*", ".*", -1)); e != nil {
 			return nil, fmt.Errorf("Invalid jobname mask: %s", e.Error())
 		}
-		name = ""
+	} else if name != "" {
+		return []string{name}, nil
 	}
-	if name == "" {
-		// Empty name means list all jobs
-		if jobnames, _, e = zkConn.Children(PATH_JOBS); e != nil {
-			return nil, fmt.Errorf("Unable to retrieve job list: %s", e.Error())
-		}
-		sort.Strings(jobnames)
+	// Empty name means list all jobs
+	children, err := store.Children(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve job list: %s", err.Error())
 	}
-	for _, jobname := range jobnames {
+	sort.Strings(children)
+	jobnames = []string{}
+	for _, jobname := range children {
 		if rxJobnames == nil || rxJobnames.MatchString(jobname) {
-			if b, _, err := zkConn.Get(fmt.Sprintf("%s/%s", PATH_JOBS, jobname)); err != nil {
-				return nil, fmt.Errorf("Can't fetch job %s: %s", jobname, err.Error())
-			} else if job, err := Deserialize(b); err != nil {
-				return nil, err
-			} else {
-				jobs = append(jobs, job)
-			}  
+			jobnames = append(jobnames, jobname)
 		}
 	}
 	return
 }
 
-// Run a job
+// Run a job started by prepareRun(), saving its combined stdout and stderr in /runs/<jobname> and the
+// outcome in /history/<jobname>
 func (job *Job) Run() {
 	log.Info.Printf("Running job %s", job.Name)
-	start := time.Now()
-	cmd := exec.Command(job.Cmd, job.Args...)
-	if err := cmd.Run(); err != nil {
-		log.Error.Printf("Job %s failed after %v seconds: %s", job.Name, time.Now().Sub(start).Seconds(), err.Error())
+	// Kill the job if another server deletes its running marker
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	trackRunning(1)
+	defer trackRunning(-1)
+	defer job.finishRunning()
+	defer close(done)
+	go job.watchRunning(stop, done)
+	record := &RunRecord{RunID: job.runID, Server: serverName, Start: job.runStart, Attempt: job.Attempt,
+		AdHoc: job.AdHoc != "", After: job.TriggeredBy}
+	buffer := &cappedBuffer{max: MaxOutputSize}
+	var timedOut, stopped bool
+	cmd, err := job.command()
+	if err == nil {
+		cmd.Stdout = buffer
+		cmd.Stderr = buffer
+		timedOut, stopped, err = runCommand(cmd, job.Timeout, stop)
+	}
+	record.End = time.Now()
+	record.ExitCode = exitCode(cmd, err)
+	record.TimedOut = timedOut
+	if timedOut {
+		record.Err = fmt.Sprintf("Timed out after %v", job.Timeout)
+		log.Error.Printf("Job %s timed out after %v seconds", job.Name, record.Seconds())
+	} else if stopped {
+		record.Err = "Replaced by a new run"
+		log.Warning.Printf("Job %s replaced by a new run after %v seconds", job.Name, record.Seconds())
+	} else if err != nil {
+		record.Err = err.Error()
+		log.Error.Printf("Job %s failed after %v seconds: %s", job.Name, record.Seconds(), err.Error())
 	} else {
-		log.Info.Printf("Job %s complete after %v seconds", job.Name, time.Now().Sub(start).Seconds())
+		log.Info.Printf("Job %s complete after %v seconds", job.Name, record.Seconds())
+	}
+
+	output := &RunOutput{
+		RunID:     record.RunID,
+		Server:    record.Server,
+		Start:     record.Start,
+		End:       record.End,
+		Err:       record.Err,
+		Output:    buffer.Bytes(),
+		Truncated: buffer.truncated,
+	}
+	if err = job.saveOutput(output); err != nil {
+		log.Error.Println(err.Error())
+	}
+	if err = job.saveHistory(record); err != nil {
+		log.Error.Println(err.Error())
+	}
+	if job.Broadcast && job.AdHoc == "" {
+		// Dependents are triggered once every server has reported on the broadcast run
+		job.reportBroadcast(record)
+		return
+	}
+	if record.Err != "" && !stopped && job.AdHoc == "" {
+		job.requestRetry(record)
+	} else if job.OneShot() && job.AdHoc == "" {
+		job.requestRetire()
+	}
+	if !stopped && (record.Err == "" || job.AdHoc != "" || job.Attempt >= job.MaxRetries) {
+		// The run is final, as it won't be retried
+		job.triggerDependents(record)
 	}
 }
 
 // Calculate the next runtime of a job using its cron-style schedule
 func (job *Job) SetNextRuntime() (changed bool, e error) {
 	currNextRuntime := job.NextRuntime
-	if cronSchedule, err := cronexpr.Parse(job.Schedule); err != nil {
-		return false, fmt.Errorf("Invalid schedule string \"%s\" for job %s: %s", job.Schedule, job.Name, err.Error())
-	} else {
-		job.NextRuntime = cronSchedule.Next(time.Now())
+	now := time.Now()
+	if job.Anchor.IsZero() {
+		if interval, _ := job.interval(); interval > 0 {
+			job.Anchor = now // Intervals of an @every job start when it's first scheduled
+		}
+	}
+	if job.BaseRuntime, e = job.nextRuntimeAfter(now); e != nil {
+		job.BaseRuntime = currNextRuntime
+		job.NextRuntime = currNextRuntime
+		return false, e
+	}
+	job.NextRuntime = job.BaseRuntime
+	if !job.BaseRuntime.IsZero() && !job.OneShot() {
+		job.NextRuntime = job.BaseRuntime.Add(job.jitterOffset())
 	}
 	return currNextRuntime != job.NextRuntime, nil
 }
 
-// Return a nicely-formatted runtime
+// Check whether a job can be scheduled to run
+func (job *Job) Runnable() bool {
+	return !job.HasError && !job.Paused && !job.NextRuntime.IsZero()
+}
+
+// Pause a job so it doesn't run until resumed
+func (job *Job) Pause() error {
+	return job.changeCurrent(func(current *Job) error {
+		if current.Paused {
+			return fmt.Errorf("Job %s is already paused", job.Name)
+		}
+		current.Paused = true
+		return nil
+	})
+}
+
+// Resume a paused job, scheduling its next run from now
+func (job *Job) Resume() error {
+	return job.changeCurrent(func(current *Job) error {
+		if !current.Paused {
+			return fmt.Errorf("Job %s is not paused", job.Name)
+		}
+		if current.OneShot() && !current.At.After(time.Now()) {
+			return fmt.Errorf("One-shot job %s was due at %s while paused; use the run command to run it", job.Name, current.At.Format(time.RFC3339))
+		}
+		current.Paused = false
+		current.Attempt = 0
+		current.LastServer = ""
+		current.CatchUp = 0
+		current.BroadcastTick = time.Time{}
+		_, err := current.SetNextRuntime()
+		return err
+	})
+}
+
+// Apply a change to a job as it's stored, reading and writing it while holding the lock so that
+// changes made by the servers since this copy was read are kept, and update this copy to match
+func (job *Job) changeCurrent(change func(current *Job) error) (e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	current, err := getJob(job.Name)
+	if err != nil {
+		return err
+	} else if err = change(current); err != nil {
+		return err
+	} else if err = current.UpdateZk(); err != nil {
+		return err
+	}
+	*job = *current
+	return nil
+}
+
+// Check the settings of a job built by the CLI
+func (job *Job) Validate() error {
+	if job.Timeout < 0 {
+		return fmt.Errorf("Invalid negative timeout %v for job %s", job.Timeout, job.Name)
+	} else if !validConcurrency(job.Concurrency) {
+		return fmt.Errorf("Invalid concurrency policy \"%s\" for job %s; must be %s, %s, or %s",
+			job.Concurrency, job.Name, CONCURRENCY_ALLOW, CONCURRENCY_FORBID, CONCURRENCY_REPLACE)
+	} else if job.MaxRetries < 0 || job.RetryDelay < 0 || job.RetryMaxDelay < 0 {
+		return fmt.Errorf("Invalid negative retry setting for job %s", job.Name)
+	} else if _, err := job.location(); err != nil {
+		return err
+	} else if len(job.Stdin) > MAX_STDIN {
+		return fmt.Errorf("Standard input of job %s is %d bytes; maximum is %d", job.Name, len(job.Stdin), MAX_STDIN)
+	} else if err := job.validateEnv(); err != nil {
+		return err
+	} else if job.MisfireThreshold < 0 || job.MisfireLimit < 0 {
+		return fmt.Errorf("Invalid negative misfire setting for job %s", job.Name)
+	} else if !validMisfire(job.Misfire) {
+		return fmt.Errorf("Invalid misfire policy \"%s\" for job %s; must be %s, %s, or %s",
+			job.Misfire, job.Name, MISFIRE_ONCE, MISFIRE_SKIP, MISFIRE_ALL)
+	} else if !validOrphans(job.Orphans) {
+		return fmt.Errorf("Invalid orphan policy \"%s\" for job %s; must be %s or %s",
+			job.Orphans, job.Name, ORPHANS_FAIL, ORPHANS_RERUN)
+	} else if job.OneShot() && job.Schedule != "" {
+		return fmt.Errorf("One-shot job %s can't also have a schedule", job.Name)
+	} else if job.OneShot() && !job.At.After(time.Now()) {
+		return fmt.Errorf("One-shot time %s of job %s has already passed", job.At.Format(time.RFC3339), job.Name)
+	} else if job.Retain < 0 || (job.Retain > 0 && !job.OneShot()) {
+		return fmt.Errorf("Invalid retention %v for job %s; only one-shot jobs are retained", job.Retain, job.Name)
+	} else if job.Jitter < 0 {
+		return fmt.Errorf("Invalid negative jitter %v for job %s", job.Jitter, job.Name)
+	} else if !validJitterMode(job.JitterMode) {
+		return fmt.Errorf("Invalid jitter mode \"%s\" for job %s; must be %s, %s, or %s",
+			job.JitterMode, job.Name, JITTER_HASH, JITTER_RANDOM, JITTER_NONE)
+	} else if err := job.validateDependencies(); err != nil {
+		return err
+	} else if _, err := matchSelector(job.Selector, nil); err != nil {
+		return fmt.Errorf("Invalid selector \"%s\" for job %s: %s", job.Selector, job.Name, err.Error())
+	} else if err := job.validateServers(); err != nil {
+		return err
+	} else if !validPlacement(job.Placement) {
+		return fmt.Errorf("Invalid placement \"%s\" for job %s; must be one of %s", job.Placement, job.Name, strings.Join(PlacementNames(), ", "))
+	} else if job.Deadline < 0 || (job.Deadline > 0 && !job.Broadcast) {
+		return fmt.Errorf("Invalid deadline %v for job %s; only broadcast jobs have a deadline", job.Deadline, job.Name)
+	} else if job.Broadcast && job.MaxRetries > 0 {
+		return fmt.Errorf("Broadcast job %s can't be retried", job.Name)
+	} else if period, err := job.period(); err != nil {
+		return err
+	} else if period > 0 && job.Jitter >= period {
+		return fmt.Errorf("Jitter %v of job %s must be less than the %v between its runs", job.Jitter, job.Name, period)
+	}
+	return nil
+}
+
+// Return a nicely-formatted runtime, in the job's time zone if it has one
 func (job *Job) FmtNextRuntime() string {
+	if loc, err := job.location(); err == nil && loc != time.Local {
+		return job.NextRuntime.In(loc).Format("2006-01-02 15:04:05.99999999 MST")
+	}
 	return job.NextRuntime.Format("2006-01-02 15:04:05.99999999")
 }
 
-// Serialize a job into a byte array
+// Serialize a job into a byte array holding a JSON envelope, as a new cluster or one migrated by the
+// migrate command has the job schema version in /config.  A cluster created by an earlier release
+// has none, and its jobs are gob-encoded until it's migrated, so its older servers can still read them.
 func (job *Job) Serialize() (b []byte, e error) {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	if e = encoder.Encode(job); e != nil {
-		e = fmt.Errorf("Unable to serialize job %s: %s", job.Name, e.Error())
+	config, err := GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to serialize job %s: %s", job.Name, err.Error())
+	} else if config.JobSchema == 0 {
+		b, e = gobEncode(job)
 	} else {
-		b = buffer.Bytes()
+		b, e = json.Marshal(jobEnvelope{Version: JOB_SCHEMA_VERSION, Job: job})
+	}
+	if e != nil {
+		e = fmt.Errorf("Unable to serialize job %s: %s", job.Name, e.Error())
 	}
 	return
 }
 
+// Check whether a serialized job is in the gob encoding used before the JSON envelope.  A gob
+// stream starts with the length of its first message, which is never a JSON object's '{'
+// once any leading whitespace is skipped.
+func IsLegacyJob(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return len(b) > 0 && b[0] != '{'
+}
+
 // Update job in znode /jobs/<jobname>
 func (job *Job) UpdateZk() (e error) {
 	if !hasLock {
@@ -143,10 +435,10 @@ func (job *Job) UpdateZk() (e error) {
 	}
 	if b, err := job.Serialize(); err != nil {
 		e = err
-	} else if _, err = zkConn.Set(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name), b, -1); err != nil {
+	} else if err = store.Set(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name), b); err != nil {
 		e = fmt.Errorf("Unable to update job %s: %s", job.Name, err.Error())
 	} else {
-		e = checkForNextjobUpdate(job)
+		e = checkForNextjobUpdate(job, false)
 	}
 	return
 }
@@ -162,12 +454,12 @@ func (job *Job) UpdateZkNextjob() (e error) {
 	if b, err := job.Serialize(); err != nil {
 		e = err
 	} else {
-		exists, _, err := zkConn.Exists(PATH_NEXT_JOB)
+		exists, err := store.Exists(PATH_NEXT_JOB)
 		if err == nil {
 			if exists {
-				_, err = zkConn.Set(PATH_NEXT_JOB, b, -1)
+				err = store.Set(PATH_NEXT_JOB, b)
 			} else {
-				_, err = zkConn.Create(PATH_NEXT_JOB, b, -1, zk.WorldACL(zk.PermAll))
+				err = store.Create(PATH_NEXT_JOB, b, false)
 			}
 		}
 		if err != nil {
@@ -187,10 +479,11 @@ func (job *Job) WriteToZk() (e error) {
 	}
 	if b, err := job.Serialize(); err != nil {
 		e = err
-	} else if _, err = zkConn.Create(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name), b, 0x0, zk.WorldACL(zk.PermAll)); err != nil {
+	} else if err = store.Create(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name), b, false); err != nil {
 		e = fmt.Errorf("Unable to create job %s: %s", job.Name, err.Error())
 	} else {
-		e = checkForNextjobUpdate(job)
+		store.Delete(fmt.Sprintf("%s/%s", PATH_ARCHIVE, job.Name)) // Replaces any archived one-shot job
+		e = checkForNextjobUpdate(job, false)
 	}
 	return
 }
@@ -203,11 +496,26 @@ func (job *Job) DeleteFromZk() (e error) {
 		}
 		defer releaseJobsLock()
 	}
-	if e = zkConn.Delete(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name), -1); e != nil {
+	if e = store.Delete(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name)); e != nil {
 		e = fmt.Errorf("Unable to delete job %s: %s", job.Name, e.Error())
 	} else {
-		job.HasError = true // Mark job as deleted
-		e = checkForNextjobUpdate(job)
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_RUNS, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete saved output of job %s: %s", job.Name, err.Error())
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_HISTORY, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete history of job %s: %s", job.Name, err.Error())
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_INFLIGHT, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete in-flight runs of job %s: %s", job.Name, err.Error())
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_ADHOC, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete pending ad-hoc runs of job %s: %s", job.Name, err.Error())
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_BROADCAST, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete broadcast run of job %s: %s", job.Name, err.Error())
+		}
+		store.Delete(fmt.Sprintf("%s/%s", PATH_RUNNING, job.Name)) // Fails harmlessly if runs are still active
+		e = checkForNextjobUpdate(job, true)
 	}
 	return
 }
@@ -0,0 +1,343 @@
+package cron
+
+import (
+	"path"
+	"sort"
+	"sync"
+)
+
+/*
+A MemoryStore is a Store held entirely in process, for tests and for a server
+running alone with -store mem://.  Several sessions can share one tree, so a
+test can run servers and the CLI against the same schedule and stop a server
+by closing its session.
+*/
+type MemoryStore struct {
+	tree    *memTree
+	mutex   sync.Mutex
+	watches []*memWatch // Watches set by this session that haven't fired
+	closed  bool
+}
+
+// The nodes, watches, and locks shared by the sessions of a MemoryStore
+type memTree struct {
+	mutex   sync.Mutex
+	nodes   map[string]*memNode
+	pending map[string][]*memWatch // Watches set by ExistsW on nodes that don't exist yet
+	locks   map[string]*memLockState
+}
+
+// A node in a memory store
+type memNode struct {
+	data     []byte
+	children map[string]bool
+	owner    *MemoryStore // Session that created an ephemeral node; nil for a permanent node
+	watches  []*memWatch
+}
+
+// A watch set on a node, for either its data or its children
+type memWatch struct {
+	events   chan Event
+	children bool
+	fired    bool
+}
+
+// Create an empty memory store with its first session
+func NewMemoryStore() *MemoryStore {
+	tree := &memTree{
+		nodes:   map[string]*memNode{"/": {children: map[string]bool{}}},
+		pending: map[string][]*memWatch{},
+		locks:   map[string]*memLockState{},
+	}
+	return &MemoryStore{tree: tree}
+}
+
+// Start another session sharing this session's tree
+func (s *MemoryStore) NewSession() *MemoryStore {
+	return &MemoryStore{tree: s.tree}
+}
+
+// Fire a watch, unless it has already fired.  The caller must hold the tree's mutex.
+func (w *memWatch) fire(event Event) {
+	if !w.fired {
+		w.fired = true
+		w.events <- event
+	}
+}
+
+// Fire the data or children watches of a node.  The caller must hold the tree's mutex.
+func (node *memNode) fire(children bool, event Event) {
+	remaining := []*memWatch{}
+	for _, w := range node.watches {
+		if w.children == children {
+			w.fire(event)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	node.watches = remaining
+}
+
+// Check that this session hasn't been closed
+func (s *MemoryStore) check() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Set a watch on a node, or on a missing node to fire when it's created.  The caller must hold the tree's mutex.
+func (s *MemoryStore) watch(p string, children bool) <-chan Event {
+	w := &memWatch{events: make(chan Event, 1), children: children}
+	if node, ok := s.tree.nodes[p]; ok {
+		node.watches = append(node.watches, w)
+	} else {
+		s.tree.pending[p] = append(s.tree.pending[p], w)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := []*memWatch{w}
+	for _, w := range s.watches {
+		if !w.fired {
+			active = append(active, w)
+		}
+	}
+	s.watches = active
+	return w.events
+}
+
+func (s *MemoryStore) Get(p string) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	if node, ok := s.tree.nodes[p]; ok {
+		return append([]byte{}, node.data...), nil
+	}
+	return nil, ErrNoNode
+}
+
+func (s *MemoryStore) GetW(p string) ([]byte, <-chan Event, error) {
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	if node, ok := s.tree.nodes[p]; ok {
+		return append([]byte{}, node.data...), s.watch(p, false), nil
+	}
+	return nil, nil, ErrNoNode
+}
+
+func (s *MemoryStore) Set(p string, data []byte) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	node, ok := s.tree.nodes[p]
+	if !ok {
+		return ErrNoNode
+	}
+	node.data = append([]byte{}, data...)
+	node.fire(false, Event{Type: EVENT_DATA_CHANGED, Path: p})
+	return nil
+}
+
+func (s *MemoryStore) Create(p string, data []byte, ephemeral bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	if _, ok := s.tree.nodes[p]; ok {
+		return ErrNodeExists
+	}
+	parentPath, name := path.Split(p)
+	parentPath = path.Clean(parentPath)
+	parent, ok := s.tree.nodes[parentPath]
+	if !ok || name == "" {
+		return ErrNoNode
+	}
+	node := &memNode{data: append([]byte{}, data...), children: map[string]bool{}}
+	if ephemeral {
+		node.owner = s
+	}
+	node.watches = s.tree.pending[p]
+	delete(s.tree.pending, p)
+	s.tree.nodes[p] = node
+	parent.children[name] = true
+	node.fire(false, Event{Type: EVENT_CREATED, Path: p})
+	parent.fire(true, Event{Type: EVENT_CHILDREN_CHANGED, Path: parentPath})
+	return nil
+}
+
+func (s *MemoryStore) Delete(p string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	return s.tree.delete(p)
+}
+
+// Delete a node that has no children.  The caller must hold the tree's mutex.
+func (tree *memTree) delete(p string) error {
+	node, ok := tree.nodes[p]
+	if !ok || p == "/" {
+		return ErrNoNode
+	} else if len(node.children) > 0 {
+		return ErrNotEmpty
+	}
+	parentPath, name := path.Split(p)
+	parentPath = path.Clean(parentPath)
+	delete(tree.nodes, p)
+	delete(tree.nodes[parentPath].children, name)
+	node.fire(false, Event{Type: EVENT_DELETED, Path: p})
+	node.fire(true, Event{Type: EVENT_DELETED, Path: p})
+	tree.nodes[parentPath].fire(true, Event{Type: EVENT_CHILDREN_CHANGED, Path: parentPath})
+	return nil
+}
+
+func (s *MemoryStore) Exists(p string) (bool, error) {
+	if err := s.check(); err != nil {
+		return false, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	_, ok := s.tree.nodes[p]
+	return ok, nil
+}
+
+func (s *MemoryStore) ExistsW(p string) (bool, <-chan Event, error) {
+	if err := s.check(); err != nil {
+		return false, nil, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	_, ok := s.tree.nodes[p]
+	return ok, s.watch(p, false), nil
+}
+
+func (s *MemoryStore) Children(p string) ([]string, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	if node, ok := s.tree.nodes[p]; ok {
+		return node.childNames(), nil
+	}
+	return nil, ErrNoNode
+}
+
+func (s *MemoryStore) ChildrenW(p string) ([]string, <-chan Event, error) {
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	if node, ok := s.tree.nodes[p]; ok {
+		return node.childNames(), s.watch(p, true), nil
+	}
+	return nil, nil, ErrNoNode
+}
+
+// Return the names of a node's children, sorted.  The caller must hold the tree's mutex.
+func (node *memNode) childNames() []string {
+	names := []string{}
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return a lock shared by every session of the tree
+func (s *MemoryStore) NewLock(p string) Locker {
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	state, ok := s.tree.locks[p]
+	if !ok {
+		state = &memLockState{held: make(chan struct{}, 1)}
+		s.tree.locks[p] = state
+	}
+	return &memLock{session: s, state: state}
+}
+
+// A lock shared by the sessions of a tree, held by the session that has sent to its channel
+type memLockState struct {
+	held   chan struct{}
+	holder *MemoryStore // Session holding the lock; nil if it's free.  Guarded by the tree's mutex.
+}
+
+// A session's handle on a lock shared by the sessions of a tree
+type memLock struct {
+	session *MemoryStore
+	state   *memLockState
+}
+
+func (lock *memLock) Lock() error {
+	if err := lock.session.check(); err != nil {
+		return err
+	}
+	lock.state.held <- struct{}{}
+	tree := lock.session.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	if err := lock.session.check(); err != nil {
+		<-lock.state.held // Closed while waiting, so Close() didn't release it
+		return err
+	}
+	lock.state.holder = lock.session
+	return nil
+}
+
+func (lock *memLock) Unlock() error {
+	tree := lock.session.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	if lock.state.holder != lock.session {
+		return ErrNoNode
+	}
+	lock.state.holder = nil
+	<-lock.state.held
+	return nil
+}
+
+// End the session, releasing its locks, deleting its ephemeral nodes, and firing its remaining watches with ErrClosed
+func (s *MemoryStore) Close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	watches := s.watches
+	s.watches = nil
+	s.mutex.Unlock()
+
+	s.tree.mutex.Lock()
+	defer s.tree.mutex.Unlock()
+	for _, w := range watches {
+		w.fire(Event{Type: EVENT_SESSION, Err: ErrClosed})
+	}
+	for _, state := range s.tree.locks {
+		if state.holder == s {
+			state.holder = nil
+			<-state.held
+		}
+	}
+	ephemeral := []string{}
+	for p, node := range s.tree.nodes {
+		if node.owner == s {
+			ephemeral = append(ephemeral, p)
+		}
+	}
+	for _, p := range ephemeral {
+		s.tree.delete(p)
+	}
+}
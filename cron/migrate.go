@@ -0,0 +1,96 @@
+package cron
+
+import (
+	"fmt"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+/*
+Switch the cluster to writing jobs as JSON envelopes and rewrite every job stored
+in the legacy gob encoding: the jobs in /jobs, /nextjob, the pending ad-hoc runs
+in /adhoc, and the archived one-shot jobs in /archive.  The switch is the job
+schema version in /config, so every server must be upgraded first.  Jobs
+already in the current format are left alone, so this can be run more than
+once, and jobs that can't be decoded are quarantined.  It holds the /jobs lock,
+so servers don't reschedule jobs while it runs, and returns the number of
+znodes rewritten.
+*/
+func MigrateJobs() (migrated int, e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	config, err := GetConfig()
+	if err != nil {
+		return 0, err
+	} else if config.JobSchema < JOB_SCHEMA_VERSION {
+		config.JobSchema = JOB_SCHEMA_VERSION
+		if err = config.Save(); err != nil {
+			return 0, err
+		}
+		log.Info.Printf("Jobs are now written as JSON schema version %d", JOB_SCHEMA_VERSION)
+	}
+	znodes, err := jobZnodes()
+	if err != nil {
+		return 0, err
+	}
+	for _, znode := range znodes {
+		if rewritten, err := migrateJob(znode); err != nil {
+			return migrated, err
+		} else if rewritten {
+			migrated++
+		}
+	}
+	return
+}
+
+// Rewrite one znode holding a job in the legacy gob encoding, returning whether it was rewritten
+func migrateJob(znode string) (bool, error) {
+	b, err := store.Get(znode)
+	if err == ErrNoNode || (err == nil && !IsLegacyJob(b)) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Can't fetch %s: %s", znode, err.Error())
+	}
+	job, err := Deserialize(b)
+	if err != nil {
+		return false, quarantine(znode, b, err)
+	} else if b, err = job.Serialize(); err != nil {
+		return false, err
+	} else if err = store.Set(znode, b); err != nil {
+		return false, fmt.Errorf("Unable to rewrite %s: %s", znode, err.Error())
+	}
+	log.Trace.Printf("Migrated job %s in %s", job.Name, znode)
+	return true, nil
+}
+
+// Return every znode holding a job: /nextjob, the jobs in /jobs and /archive, and the pending ad-hoc runs in /adhoc
+func jobZnodes() ([]string, error) {
+	znodes := []string{PATH_NEXT_JOB}
+	for _, root := range []string{PATH_JOBS, PATH_ARCHIVE} {
+		children, err := store.Children(root)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list %s: %s", root, err.Error())
+		}
+		for _, child := range children {
+			znodes = append(znodes, fmt.Sprintf("%s/%s", root, child))
+		}
+	}
+	jobnames, err := store.Children(PATH_ADHOC)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s: %s", PATH_ADHOC, err.Error())
+	}
+	for _, jobname := range jobnames {
+		runIDs, err := store.Children(fmt.Sprintf("%s/%s", PATH_ADHOC, jobname))
+		if err != nil && err != ErrNoNode {
+			return nil, fmt.Errorf("Unable to list ad-hoc runs of job %s: %s", jobname, err.Error())
+		}
+		for _, runID := range runIDs {
+			znodes = append(znodes, fmt.Sprintf("%s/%s/%s", PATH_ADHOC, jobname, runID))
+		}
+	}
+	return znodes, nil
+}
@@ -0,0 +1,132 @@
+package cron
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Give the store the empty /config of a cluster created by an earlier release
+func useLegacyConfig(t *testing.T) {
+	if err := store.Set(PATH_CONFIG, []byte{}); err != nil {
+		t.Fatalf("Can't clear configuration: %s", err.Error())
+	}
+	dropConfig(nil)
+}
+
+func TestSerializeJSON(t *testing.T) {
+	useMemoryStore(t)
+	useLegacyConfig(t)
+	job := &Job{Name: "json", Schedule: "@hourly", Cmd: "echo", Args: []string{"a"}, Env: map[string]string{"X": "1"},
+		Timeout: time.Minute, NextRuntime: time.Date(2026, 6, 1, 2, 3, 4, 5, time.UTC)}
+
+	// Jobs of an earlier release's cluster are gob-encoded, as its servers read them, until it's migrated
+	for _, schema := range []int{0, JOB_SCHEMA_VERSION} {
+		if err := (&ClusterConfig{JobSchema: schema}).Save(); err != nil {
+			t.Fatalf("Can't set job schema %d: %s", schema, err.Error())
+		}
+		b, err := job.Serialize()
+		if err != nil {
+			t.Fatalf("Can't serialize job: %s", err.Error())
+		} else if isJSON := bytes.HasPrefix(b, []byte(`{"version":1,"job":{"Name":"json"`)); isJSON != (schema > 0) || IsLegacyJob(b) == isJSON {
+			t.Errorf("Unexpected job serialized with schema %d: %s", schema, b)
+		}
+		if job2, err := Deserialize(b); err != nil {
+			t.Errorf("Can't deserialize job: %s", err.Error())
+		} else if job2.Name != job.Name || job2.Args[0] != "a" || job2.Env["X"] != "1" ||
+			job2.Timeout != job.Timeout || !job2.NextRuntime.Equal(job.NextRuntime) {
+			t.Errorf("Deserialized job %+v differs from %+v", job2, job)
+		}
+	}
+	if b := []byte(" \n\t{\"version\":1,\"job\":{\"Name\":\"json\"}}"); IsLegacyJob(b) {
+		t.Errorf("JSON with leading whitespace taken for a legacy job: %q", b)
+	} else if job2, err := Deserialize(b); err != nil || job2.Name != "json" {
+		t.Errorf("Can't deserialize JSON with leading whitespace: %+v %v", job2, err)
+	}
+
+	// A job isn't written as gob when the configuration can't be read
+	store.Set(PATH_CONFIG, []byte("{garbage"))
+	dropConfig(nil)
+	if b, err := job.Serialize(); err == nil {
+		t.Errorf("Serialized job without configuration: %s", b)
+	}
+}
+
+func TestNewClusterConfig(t *testing.T) {
+	useMemoryStore(t)
+	if b, err := store.Get(PATH_CONFIG); err != nil || !bytes.HasPrefix(b, []byte("{")) {
+		t.Errorf("Configuration of a new cluster isn't JSON: %q %v", b, err)
+	} else if config, err := GetConfig(); err != nil || config.JobSchema != JOB_SCHEMA_VERSION {
+		t.Errorf("New cluster doesn't write JSON jobs: %+v %v", config, err)
+	}
+
+	// A cluster with jobs keeps an earlier release's settings, which are gob-encoded
+	s := store
+	legacy, _ := gobEncode(&ClusterConfig{Jitter: time.Minute})
+	s.Set(PATH_CONFIG, legacy)
+	s.Create(PATH_JOBS+"/legacy", []byte{}, false)
+	store = nil
+	dropConfig(nil)
+	if err := InitStore(s); err != nil {
+		t.Fatalf("Unable to initialize store: %s", err.Error())
+	} else if config, err := GetConfig(); err != nil || config.JobSchema != 0 || config.Jitter != time.Minute {
+		t.Errorf("Unexpected configuration of an existing cluster: %+v %v", config, err)
+	}
+}
+
+func TestMigrateJobs(t *testing.T) {
+	useMemoryStore(t)
+	useLegacyConfig(t)
+	legacy := &Job{Name: "legacy", Schedule: "@hourly", Cmd: "true"}
+	if _, err := legacy.SetNextRuntime(); err != nil {
+		t.Fatalf("Can't schedule job: %s", err.Error())
+	}
+	b, _ := gobEncode(legacy)
+	store.Create(PATH_JOBS+"/legacy", b, false)
+	store.Set(PATH_NEXT_JOB, b)
+	addJob(t, &Job{Name: "current", Schedule: "0 0 1 1 *", Cmd: "true"})
+	if jobs, err := ListJobs("legacy"); err != nil || len(jobs) != 1 || jobs[0].Schedule != "@hourly" {
+		t.Errorf("Legacy job not read: %v %v", jobs, err)
+	}
+
+	if migrated, err := MigrateJobs(); err != nil || migrated != 3 {
+		t.Errorf("Migrated %d jobs (%v); expected 3", migrated, err)
+	}
+	if config, err := GetConfig(); err != nil || config.JobSchema != JOB_SCHEMA_VERSION {
+		t.Errorf("Job schema %+v not set by migration: %v", config, err)
+	}
+	addJob(t, &Job{Name: "added", Schedule: "0 0 1 1 *", Cmd: "true"})
+	for _, znode := range []string{PATH_JOBS + "/legacy", PATH_JOBS + "/current", PATH_JOBS + "/added", PATH_NEXT_JOB} {
+		if b, err := store.Get(znode); err != nil || IsLegacyJob(b) {
+			t.Errorf("%s not migrated: %s %v", znode, b, err)
+		} else if _, err = Deserialize(b); err != nil {
+			t.Errorf("%s unreadable after migration: %s", znode, err.Error())
+		}
+	}
+	if migrated, err := MigrateJobs(); err != nil || migrated != 0 {
+		t.Errorf("Migrated %d jobs (%v) a second time", migrated, err)
+	}
+}
+
+func TestConfigAfterMigrate(t *testing.T) {
+	useMemoryStore(t)
+
+	// Settings read by the config command before a migration are saved after it
+	stale, err := GetConfig()
+	if err != nil {
+		t.Fatalf("Can't get configuration: %s", err.Error())
+	}
+	if _, err = MigrateJobs(); err != nil {
+		t.Fatalf("Can't migrate jobs: %s", err.Error())
+	}
+	stale.Jitter = time.Minute
+	if err = stale.Save(); err != nil {
+		t.Fatalf("Can't save configuration: %s", err.Error())
+	}
+	if config, err := GetConfig(); err != nil || config.JobSchema != JOB_SCHEMA_VERSION || config.Jitter != time.Minute {
+		t.Errorf("Unexpected configuration %+v after migration: %v", config, err)
+	}
+	if b, err := (&Job{Name: "json", Schedule: "@hourly", Cmd: "true"}).Serialize(); err != nil || IsLegacyJob(b) {
+		t.Errorf("Job serialized as gob after migration: %v", err)
+	}
+}
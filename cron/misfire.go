@@ -0,0 +1,83 @@
+package cron
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Misfire policies, which determine what happens when a job is found more than its
+// misfire threshold past its runtime, typically because the whole cluster was down
+const (
+	MISFIRE_ONCE = "once" // Run the job once and skip any other missed runs (the default)
+	MISFIRE_SKIP = "skip" // Drop the late run and all other missed runs
+	MISFIRE_ALL  = "all"  // Run every missed occurrence, up to the job's misfire limit
+)
+
+const (
+	DEFAULT_MISFIRE_THRESHOLD = time.Minute // Default lateness beyond which a run counts as missed
+	DEFAULT_MISFIRE_LIMIT     = 10          // Default maximum number of missed runs caught up by the "all" policy
+)
+
+// Check that a misfire policy is valid
+func validMisfire(policy string) bool {
+	switch strings.ToLower(policy) {
+	case "", MISFIRE_ONCE, MISFIRE_SKIP, MISFIRE_ALL:
+		return true
+	}
+	return false
+}
+
+/*
+Decide whether to run a job that's due, applying its misfire policy if it's
+later than its misfire threshold.  For the "all" policy, this sets CatchUp to
+the number of missed runs to make, and updateSchedule() then sets the job's
+next runtime to each missed occurrence in turn rather than the next one after now.
+*/
+func (job *Job) applyMisfirePolicy(now time.Time) (run bool) {
+	if job.CatchUp > 0 {
+		return true // Already catching up on missed runs
+	}
+	threshold := job.MisfireThreshold
+	if threshold <= 0 {
+		threshold = DEFAULT_MISFIRE_THRESHOLD
+	}
+	late := now.Sub(job.NextRuntime)
+	if late <= threshold {
+		return true
+	}
+
+	switch strings.ToLower(job.Misfire) {
+	case MISFIRE_SKIP:
+		log.Warning.Printf("Skipping job %s scheduled for %s as it's %v late", job.Name, job.FmtNextRuntime(), late)
+		return false
+
+	case MISFIRE_ALL:
+		limit := job.MisfireLimit
+		if limit <= 0 {
+			limit = DEFAULT_MISFIRE_LIMIT
+		}
+		missed, err := job.missedRuns(now, limit)
+		if err != nil {
+			log.Error.Println(err.Error())
+		}
+		job.CatchUp = missed
+		log.Warning.Printf("Job %s scheduled for %s is %v late; catching up %d missed run(s)", job.Name, job.FmtNextRuntime(), late, missed)
+
+	default:
+		log.Warning.Printf("Job %s scheduled for %s is %v late; running once", job.Name, job.FmtNextRuntime(), late)
+	}
+	return true
+}
+
+// Count the occurrences of a job's schedule from its next runtime up to now, up to a limit
+func (job *Job) missedRuns(now time.Time, limit int) (missed int, e error) {
+	for t := job.NextRuntime; missed < limit && !t.IsZero() && !t.After(now); missed++ {
+		if t, e = job.nextRuntimeAfter(t); e != nil {
+			return missed + 1, fmt.Errorf("Unable to count missed runs of job %s: %s", job.Name, e.Error())
+		}
+	}
+	return
+}
@@ -0,0 +1,37 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMisfirePolicies(t *testing.T) {
+	due := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	missed := 150 * time.Minute // Missed the runs at 00:00, 01:00, and 02:00
+	tests := []struct {
+		job     Job
+		late    time.Duration
+		run     bool
+		catchUp int
+	}{
+		{Job{Name: "on-time"}, time.Second, true, 0},
+		{Job{Name: "once", Misfire: MISFIRE_ONCE}, missed, true, 0},
+		{Job{Name: "skip", Misfire: MISFIRE_SKIP}, missed, false, 0},
+		{Job{Name: "all", Misfire: MISFIRE_ALL}, missed, true, 3},
+		{Job{Name: "all-limited", Misfire: MISFIRE_ALL, MisfireLimit: 2}, missed, true, 2},
+		{Job{Name: "within-threshold", Misfire: MISFIRE_SKIP, MisfireThreshold: 3 * time.Hour}, missed, true, 0},
+		{Job{Name: "catching-up", Misfire: MISFIRE_SKIP, CatchUp: 2}, missed, true, 2},
+	}
+	for _, test := range tests {
+		job := test.job
+		job.Schedule = "0 * * * *"
+		job.TZ = "UTC"
+		job.NextRuntime = due
+		if run := job.applyMisfirePolicy(due.Add(test.late)); run != test.run {
+			t.Errorf("Job %s: run is %t; expected %t", job.Name, run, test.run)
+		}
+		if job.CatchUp != test.catchUp {
+			t.Errorf("Job %s: catch up is %d; expected %d", job.Name, job.CatchUp, test.catchUp)
+		}
+	}
+}
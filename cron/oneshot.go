@@ -0,0 +1,122 @@
+package cron
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Time the retention of the first archived job to expire ends, when Run() next purges the archive; zero if none
+var nextPurge time.Time
+
+// Check whether a job is a one-shot job, which runs once at time At rather than on a schedule
+func (job *Job) OneShot() bool {
+	return !job.At.IsZero()
+}
+
+/*
+Retire a one-shot job whose run is over.  A job with a retention period is
+moved to /archive/<jobname>, keeping its output and history until the period
+ends; otherwise it's deleted.  The caller must hold the lock.
+*/
+func (job *Job) retire() {
+	if job.Retain <= 0 {
+		if err := job.DeleteFromZk(); err != nil {
+			log.Error.Printf("Unable to delete one-shot job %s: %s", job.Name, err.Error())
+		} else {
+			log.Info.Printf("One-shot job %s deleted after its run", job.Name)
+		}
+		return
+	}
+	job.Retired = time.Now()
+	archivePath := fmt.Sprintf("%s/%s", PATH_ARCHIVE, job.Name)
+	if b, err := job.Serialize(); err != nil {
+		log.Error.Println(err.Error())
+	} else if err = store.Delete(archivePath); err != nil && err != ErrNoNode {
+		log.Error.Printf("Unable to replace archived job %s: %s", job.Name, err.Error())
+	} else if err = store.Create(archivePath, b, false); err != nil {
+		log.Error.Printf("Unable to archive one-shot job %s: %s", job.Name, err.Error())
+	} else if err = store.Delete(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name)); err != nil {
+		log.Error.Printf("Unable to remove archived one-shot job %s: %s", job.Name, err.Error())
+	} else if err = checkForNextjobUpdate(job, true); err != nil {
+		log.Error.Println(err.Error())
+	} else {
+		log.Info.Printf("One-shot job %s archived for %v after its run", job.Name, job.Retain)
+	}
+	purgeArchive()
+}
+
+// Ask the server loop to retire a one-shot job once its run is over, unless it has been rescheduled since
+func (job *Job) requestRetire() {
+	submitLocked(func() {
+		if current, err := getJob(job.Name); err != nil {
+			log.Trace.Printf("One-shot job %s no longer exists: %s", job.Name, err.Error())
+		} else if current.OneShot() && current.NextRuntime.IsZero() {
+			current.retire()
+		}
+	})
+}
+
+// Delete archived one-shot jobs whose retention period has ended, along with their output and history,
+// and note when the next one ends.  The caller must hold the lock.
+func purgeArchive() {
+	jobs, err := ListArchive("")
+	if err != nil {
+		log.Warning.Println(err.Error())
+		return
+	}
+	now := time.Now()
+	nextPurge = time.Time{}
+	for _, job := range jobs {
+		if expiry := job.Retired.Add(job.Retain); expiry.After(now) {
+			if nextPurge.IsZero() || expiry.Before(nextPurge) {
+				nextPurge = expiry
+			}
+			continue
+		}
+		log.Info.Printf("Retention of archived one-shot job %s has ended", job.Name)
+		if err = store.Delete(fmt.Sprintf("%s/%s", PATH_ARCHIVE, job.Name)); err != nil && err != ErrNoNode {
+			log.Warning.Printf("Unable to delete archived job %s: %s", job.Name, err.Error())
+		} else if exists, err := store.Exists(fmt.Sprintf("%s/%s", PATH_JOBS, job.Name)); err != nil || exists {
+			continue // A new job with the same name owns the output and history
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_RUNS, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete saved output of job %s: %s", job.Name, err.Error())
+		}
+		if err := deleteTree(fmt.Sprintf("%s/%s", PATH_HISTORY, job.Name)); err != nil {
+			log.Warning.Printf("Unable to delete history of job %s: %s", job.Name, err.Error())
+		}
+	}
+}
+
+// Return a channel that fires when the archive is next due to be purged, or nil if nothing is archived
+func purgeTimer() <-chan time.Time {
+	if nextPurge.IsZero() {
+		return nil
+	}
+	return time.After(nextPurge.Sub(time.Now()))
+}
+
+// Get an archived one-shot job or a list of archived jobs, matching names and skipping jobs that
+// can't be decoded as ListJobs() does
+func ListArchive(name string) (jobs []*Job, e error) {
+	jobnames, err := matchJobnames(PATH_ARCHIVE, name)
+	if err != nil {
+		return nil, err
+	}
+	jobs = []*Job{}
+	for _, jobname := range jobnames {
+		znode := fmt.Sprintf("%s/%s", PATH_ARCHIVE, jobname)
+		if b, err := store.Get(znode); err == ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Can't fetch archived job %s: %s", jobname, err.Error())
+		} else if job, err := Deserialize(b); err != nil {
+			skipUndecodable(znode, err)
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+	return
+}
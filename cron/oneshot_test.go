@@ -0,0 +1,25 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeArchive(t *testing.T) {
+	useMemoryStore(t)
+	retired := time.Now().Add(-time.Hour)
+	for _, job := range []*Job{
+		{Name: "expired", Cmd: "true", Retain: time.Minute, Retired: retired},
+		{Name: "kept", Cmd: "true", Retain: 2 * time.Hour, Retired: retired},
+	} {
+		b, _ := job.Serialize()
+		store.Create(PATH_ARCHIVE+"/"+job.Name, b, false)
+	}
+	purgeArchive()
+	if jobs, err := ListArchive(""); err != nil || len(jobs) != 1 || jobs[0].Name != "kept" {
+		t.Errorf("Unexpected archive after purge %v: %v", jobs, err)
+	}
+	if expiry := retired.Add(2 * time.Hour); !nextPurge.Equal(expiry) {
+		t.Errorf("Next purge at %s; expected %s", nextPurge, expiry)
+	}
+}
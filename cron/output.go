@@ -0,0 +1,117 @@
+package cron
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+const (
+	DEFAULT_MAX_OUTPUT  = 64 * 1024 // Default maximum bytes of output saved per run
+	DEFAULT_OUTPUT_RUNS = 10        // Default number of runs of output saved per job
+)
+
+var (
+	MaxOutputSize  = DEFAULT_MAX_OUTPUT  // Maximum bytes of combined stdout/stderr saved per run
+	OutputRunsKept = DEFAULT_OUTPUT_RUNS // Number of runs of output kept in /runs/<jobname>
+)
+
+// Output captured from a single run of a job, stored in znode /runs/<jobname>/<runid>
+type RunOutput struct {
+	RunID     string    // Unique id of this run
+	Server    string    // Name of server that ran the job
+	Start     time.Time // Time job started
+	End       time.Time // Time job ended
+	Err       string    // Error returned by the command, if any
+	Output    []byte    // Combined stdout and stderr of the command
+	Truncated bool      // Output exceeded MaxOutputSize and was truncated
+}
+
+// A bytes.Buffer that silently discards anything written beyond its maximum size
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// Generate an id for a run.  Ids sort in order of start time.
+func newRunID(start time.Time) string {
+	name := serverName
+	if name == "" {
+		name = hostname
+	}
+	return fmt.Sprintf("%019d-%s", start.UnixNano(), name)
+}
+
+// Return the start time encoded in a run id
+func runIDTime(runID string) time.Time {
+	var nanos int64
+	fmt.Sscanf(runID, "%019d-", &nanos)
+	return time.Unix(0, nanos)
+}
+
+// Save the output of a run in znode /runs/<jobname>/<runid> and discard the oldest saved output
+func (job *Job) saveOutput(output *RunOutput) error {
+	jobPath := fmt.Sprintf("%s/%s", PATH_RUNS, job.Name)
+	if b, err := gobEncode(output); err != nil {
+		return fmt.Errorf("Unable to serialize output of job %s: %s", job.Name, err.Error())
+	} else if err = ensurePath(jobPath); err != nil {
+		return err
+	} else if err = store.Create(fmt.Sprintf("%s/%s", jobPath, output.RunID), b, false); err != nil {
+		return fmt.Errorf("Unable to save output of job %s: %s", job.Name, err.Error())
+	}
+
+	if runs, err := store.Children(jobPath); err != nil {
+		return fmt.Errorf("Unable to list saved output of job %s: %s", job.Name, err.Error())
+	} else if len(runs) > OutputRunsKept {
+		sort.Strings(runs)
+		for _, run := range runs[:len(runs)-OutputRunsKept] {
+			if err = store.Delete(fmt.Sprintf("%s/%s", jobPath, run)); err != nil && err != ErrNoNode {
+				log.Warning.Printf("Unable to delete old output %s of job %s: %s", run, job.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Get the saved output of the last n runs of a job, most recent first.  n <= 0 returns all saved output.
+func ListOutput(name string, n int) (outputs []*RunOutput, e error) {
+	jobPath := fmt.Sprintf("%s/%s", PATH_RUNS, name)
+	runs, err := store.Children(jobPath)
+	if err == ErrNoNode {
+		return []*RunOutput{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to list saved output of job %s: %s", name, err.Error())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runs)))
+	if n > 0 && len(runs) > n {
+		runs = runs[:n]
+	}
+	outputs = []*RunOutput{}
+	for _, run := range runs {
+		output := &RunOutput{}
+		if b, err := store.Get(fmt.Sprintf("%s/%s", jobPath, run)); err == ErrNoNode {
+			continue // Discarded since we listed the runs
+		} else if err != nil {
+			return nil, fmt.Errorf("Can't fetch output %s of job %s: %s", run, name, err.Error())
+		} else if err = gobDecode(b, output); err != nil {
+			return nil, fmt.Errorf("Unable to decode output %s of job %s: %s", run, name, err.Error())
+		}
+		outputs = append(outputs, output)
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package cron
+
+import (
+	"testing"
+)
+
+func TestCappedBuffer(t *testing.T) {
+	tests := []struct {
+		max       int
+		writes    []string
+		expected  string
+		truncated bool
+	}{
+		{10, []string{"hello"}, "hello", false},
+		{10, []string{"hello", "world"}, "helloworld", false},
+		{10, []string{"hello", "world", "!"}, "helloworld", true},
+		{8, []string{"hello", "world"}, "hellowor", true},
+		{8, []string{"hello", "world", "again", ""}, "hellowor", true},
+		{4, []string{"hello"}, "hell", true},
+		{0, []string{"hello"}, "", true},
+		{0, []string{""}, "", false},
+	}
+	for _, test := range tests {
+		buffer := &cappedBuffer{max: test.max}
+		for _, s := range test.writes {
+			// The full length is reported so the command doesn't see a failed write
+			if n, err := buffer.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("Writes %q with max %d: write of %q returned %d, %v; expected %d, nil", test.writes, test.max, s, n, err, len(s))
+			}
+		}
+		if got := buffer.String(); got != test.expected {
+			t.Errorf("Writes %q with max %d saved %q; expected %q", test.writes, test.max, got, test.expected)
+		}
+		if buffer.truncated != test.truncated {
+			t.Errorf("Writes %q with max %d: truncated is %v; expected %v", test.writes, test.max, buffer.truncated, test.truncated)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package cron
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Placement strategies, which determine which server runs a job when it's due
+const (
+	PLACEMENT_RANDOM        = "random"        // A server chosen at random for each run (the default)
+	PLACEMENT_ROUND_ROBIN   = "round-robin"   // Each server in turn, by name
+	PLACEMENT_LEAST_RUNNING = "least-running" // The server running the fewest jobs
+	PLACEMENT_RACE          = "race"          // Whichever server gets the lock first
+)
+
+const (
+	PLACEMENT_FALLBACK = 5 * time.Second // How long other servers leave a due run to the server chosen for it to claim
+)
+
+/*
+A PlacementStrategy chooses the server to run a job from the servers that can
+run it.  Every server makes the choice independently when the job is due, so
+a strategy must choose the same server given the same job and candidates.
+*/
+type PlacementStrategy interface {
+	// Choose a server from candidates sorted by name, or return nil to let them all contend for the lock
+	Choose(job *Job, candidates []*ServerInfo) *ServerInfo
+}
+
+var (
+	placementStrategies = map[string]PlacementStrategy{
+		PLACEMENT_RANDOM:        randomPlacement{},
+		PLACEMENT_ROUND_ROBIN:   roundRobinPlacement{},
+		PLACEMENT_LEAST_RUNNING: leastRunningPlacement{},
+		PLACEMENT_RACE:          racePlacement{},
+	}
+	runningCount int32 // Number of runs active on this server, published in /servers/<servername>
+)
+
+// Add a placement strategy, or replace an existing one, under a name jobs and the config command can use
+func RegisterPlacement(name string, strategy PlacementStrategy) {
+	placementStrategies[strings.ToLower(name)] = strategy
+}
+
+// Check that a placement strategy is registered
+func validPlacement(name string) bool {
+	_, ok := placementStrategies[strings.ToLower(name)]
+	return ok || name == ""
+}
+
+// Return the names of the registered placement strategies
+func PlacementNames() []string {
+	names := []string{}
+	for name := range placementStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return the job's placement strategy, which defaults to the cluster's and then to random
+func (job *Job) placementStrategy() PlacementStrategy {
+	name := strings.ToLower(job.Placement)
+	if name == "" {
+		if config, err := GetConfig(); err != nil {
+			log.Warning.Println(err.Error())
+		} else {
+			name = strings.ToLower(config.Placement)
+		}
+	}
+	if strategy, ok := placementStrategies[name]; ok {
+		return strategy
+	}
+	return placementStrategies[PLACEMENT_RANDOM]
+}
+
+/*
+Choose the server that should run a job that's due, or return "" if any
+server can take it.  The candidates are the started servers that the job's
+placement constraints allow.  A retry avoids the server where the run failed
+if another candidate is available.
+*/
+func (job *Job) choosePlacement(servers map[string]*ServerInfo) string {
+	candidates := []*ServerInfo{}
+	for _, info := range servers {
+		if info.Started && job.placeableOn(info) && !(job.Attempt > 0 && info.Name == job.LastServer) {
+			candidates = append(candidates, info)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+	if chosen := job.placementStrategy().Choose(job, candidates); chosen != nil {
+		return chosen.Name
+	}
+	return ""
+}
+
+// A server's claim to a due run, held in ephemeral znode /claims/<jobname>
+type runClaim struct {
+	Server string // Server that claimed the run
+	Run    string // Run claimed, as returned by runKey()
+}
+
+// Return the path of a job's claim
+func claimPath(name string) string {
+	return fmt.Sprintf("%s/%s", PATH_CLAIMS, name)
+}
+
+// Return a key identifying a job's pending run, which is the same on every server
+func (job *Job) runKey() string {
+	return fmt.Sprintf("%s/%s/%d", job.Name, job.AdHoc, job.NextRuntime.UnixNano())
+}
+
+/*
+Check whether this server should run a job that's due, claiming the run if so.
+The server chosen by the job's placement strategy claims the run at once.  The
+others leave it to the claimant for as long as its claim stands, as the claim
+is ephemeral and ends if the claimant stops.  If no server claims the run by
+PLACEMENT_FALLBACK after it was due, every server contends to claim it.  When
+no server is chosen, the first to claim the run takes it, though a retry is
+first left to other servers if it failed on this one.  If this server isn't to
+run the job, return a watch on the claim and, if no claim stands, how long to
+wait before checking again.
+*/
+func (job *Job) claimRun(now time.Time) (claimed bool, wait time.Duration, watch <-chan Event, e error) {
+	znode := claimPath(job.Name)
+	for {
+		exists, claimWatch, err := store.ExistsW(znode)
+		if err != nil {
+			return false, 0, nil, fmt.Errorf("Unable to check claim of job %s: %s", job.Name, err.Error())
+		}
+		if exists {
+			claim := &runClaim{}
+			if b, err := store.Get(znode); err == ErrNoNode {
+				continue // Claim ended since we checked it
+			} else if err != nil {
+				return false, 0, nil, fmt.Errorf("Unable to get claim of job %s: %s", job.Name, err.Error())
+			} else if err = gobDecode(b, claim); err == nil && claim.Run == job.runKey() {
+				if claim.Server == serverName {
+					return true, 0, nil, nil
+				}
+				log.Trace.Printf("Leaving job %s to server %s, which claimed it", job.Name, claim.Server)
+				return false, 0, claimWatch, nil
+			}
+			// The claim is for an earlier run, so discard it
+			if err = store.Delete(znode); err != nil && err != ErrNoNode {
+				return false, 0, nil, fmt.Errorf("Unable to delete stale claim of job %s: %s", job.Name, err.Error())
+			}
+			continue
+		}
+		servers, err := getServers()
+		if err != nil {
+			return false, 0, nil, err
+		}
+		if chosen := job.choosePlacement(servers); chosen == "" {
+			if wait = job.deferRetry(now); wait > 0 {
+				log.Trace.Printf("Leaving retry of job %s to another server for %v", job.Name, wait)
+				return false, wait, claimWatch, nil
+			}
+		} else if chosen != serverName {
+			if wait = job.NextRuntime.Add(PLACEMENT_FALLBACK).Sub(now); wait > 0 {
+				log.Trace.Printf("Leaving job %s to server %s for %v", job.Name, chosen, wait)
+				return false, wait, claimWatch, nil
+			}
+			log.Info.Printf("Server %s hasn't claimed job %s; contending for it", chosen, job.Name)
+		}
+		b, err := gobEncode(&runClaim{Server: serverName, Run: job.runKey()})
+		if err != nil {
+			return false, 0, nil, fmt.Errorf("Unable to serialize claim of job %s: %s", job.Name, err.Error())
+		}
+		if err = store.Create(znode, b, true); err == nil {
+			log.Trace.Printf("Claimed job %s", job.Name)
+			return true, 0, nil, nil
+		} else if err != ErrNodeExists {
+			return false, 0, nil, fmt.Errorf("Unable to claim job %s: %s", job.Name, err.Error())
+		}
+		// Another server claimed the run first
+	}
+}
+
+// Drop this server's claim to a job's run once the run has started and the job is rescheduled
+func (job *Job) dropClaim() {
+	znode := claimPath(job.Name)
+	claim := &runClaim{}
+	if b, err := store.Get(znode); err != nil {
+		if err != ErrNoNode {
+			log.Warning.Printf("Unable to get claim of job %s: %s", job.Name, err.Error())
+		}
+	} else if err = gobDecode(b, claim); err == nil && claim.Server != serverName {
+		// Another server's claim
+	} else if err = store.Delete(znode); err != nil && err != ErrNoNode {
+		log.Warning.Printf("Unable to delete claim of job %s: %s", job.Name, err.Error())
+	}
+}
+
+// Add to the number of runs active on this server and publish it for least-running placement
+func trackRunning(delta int32) {
+	atomic.AddInt32(&runningCount, delta)
+	if err := localServerInfo(true).save(); err != nil {
+		log.Warning.Println(err.Error())
+	}
+}
+
+// Return a hash of a job's pending run, which is the same on every server
+func (job *Job) placementHash() uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(job.runKey()))
+	return hash.Sum64()
+}
+
+// Choose a server by hashing the job's pending run, so every server makes the same random choice
+type randomPlacement struct{}
+
+func (randomPlacement) Choose(job *Job, candidates []*ServerInfo) *ServerInfo {
+	return candidates[job.placementHash()%uint64(len(candidates))]
+}
+
+// Choose the server that follows, by name, the one that ran the job last
+type roundRobinPlacement struct{}
+
+func (roundRobinPlacement) Choose(job *Job, candidates []*ServerInfo) *ServerInfo {
+	for _, info := range candidates {
+		if info.Name > job.PlacedOn {
+			return info
+		}
+	}
+	return candidates[0]
+}
+
+// Choose the server running the fewest jobs, breaking ties at random
+type leastRunningPlacement struct{}
+
+func (leastRunningPlacement) Choose(job *Job, candidates []*ServerInfo) *ServerInfo {
+	least := []*ServerInfo{}
+	for _, info := range candidates {
+		if len(least) == 0 || info.Running < least[0].Running {
+			least = []*ServerInfo{info}
+		} else if info.Running == least[0].Running {
+			least = append(least, info)
+		}
+	}
+	return randomPlacement{}.Choose(job, least)
+}
+
+// Don't choose a server; the first to get the lock runs the job
+type racePlacement struct{}
+
+func (racePlacement) Choose(job *Job, candidates []*ServerInfo) *ServerInfo {
+	return nil
+}
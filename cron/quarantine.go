@@ -0,0 +1,179 @@
+package cron
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// A znode whose job couldn't be decoded, stored under /quarantine at the znode's path within the namespace
+type QuarantinedJob struct {
+	Path string    // Znode the job was read from, e.g. /castle-cron/jobs/jobname
+	Data []byte    // Data of the znode when it was quarantined
+	Err  string    // Error decoding the data
+	Time time.Time // Time the znode was quarantined
+}
+
+// Return the name of the job a quarantined znode held, or an empty string for /nextjob
+func (q *QuarantinedJob) Name() string {
+	parts := strings.Split(strings.TrimPrefix(q.Path, NAMESPACE+"/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Delete a znode from /quarantine once its job has been dealt with
+func (q *QuarantinedJob) Clear() error {
+	if err := store.Delete(quarantinePath(q.Path)); err != nil && err != ErrNoNode {
+		return fmt.Errorf("Unable to clear quarantined %s: %s", q.Path, err.Error())
+	}
+	return nil
+}
+
+// Return the znode under /quarantine that holds a znode's quarantined data
+func quarantinePath(znode string) string {
+	return PATH_QUARANTINE + strings.TrimPrefix(znode, NAMESPACE)
+}
+
+/*
+Move a znode whose job can't be decoded to /quarantine, so that the rest of the
+schedule carries on without it.  The quarantined copy keeps the data as found,
+for inspection by the doctor command.  /nextjob is only a copy of a job, so
+rather than being deleted it's recalculated from the jobs themselves.  Nothing
+is done if the znode has changed since it was read.
+*/
+func quarantine(znode string, b []byte, cause error) (e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	if current, err := store.Get(znode); err == ErrNoNode || (err == nil && string(current) != string(b)) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to check %s before quarantining it: %s", znode, err.Error())
+	}
+	qpath := quarantinePath(znode)
+	parents := []string{}
+	for parent := path.Dir(qpath); parent != PATH_QUARANTINE; parent = path.Dir(parent) {
+		parents = append([]string{parent}, parents...)
+	}
+	for _, parent := range parents {
+		if e = ensurePath(parent); e != nil {
+			return
+		}
+	}
+	record, err := gobEncode(&QuarantinedJob{Path: znode, Data: b, Err: cause.Error(), Time: time.Now()})
+	if err != nil {
+		return fmt.Errorf("Unable to encode quarantine record of %s: %s", znode, err.Error())
+	}
+	if err = store.Create(qpath, record, false); err == ErrNodeExists {
+		err = store.Set(qpath, record)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to quarantine %s: %s", znode, err.Error())
+	}
+	log.Error.Printf("Quarantined %s in %s: %s", znode, qpath, cause.Error())
+
+	if znode == PATH_NEXT_JOB {
+		return setNextjob()
+	} else if err = store.Delete(znode); err != nil && err != ErrNoNode {
+		return fmt.Errorf("Unable to remove quarantined %s: %s", znode, err.Error())
+	} else if strings.HasPrefix(znode, PATH_ADHOC+"/") {
+		store.Delete(path.Dir(znode)) // Fails harmlessly if other runs are pending
+	}
+	return nil
+}
+
+// Report a znode whose job can't be decoded and is left out of a list of jobs.  Listing doesn't take
+// the lock, so the znode is left in place for the server or the doctor command to quarantine.
+func skipUndecodable(znode string, cause error) {
+	log.Warning.Printf("Skipping %s, which can't be decoded: %s; run castle-cron doctor to quarantine it", znode, cause.Error())
+}
+
+/*
+Read every znode holding a job, quarantining any that can't be decoded, so that
+ListQuarantine() reports all the bad data in the cluster.  Returns the number of
+jobs still in the legacy gob encoding, which the migrate command rewrites.
+*/
+func CheckJobs() (legacy int, e error) {
+	if !hasLock {
+		if e = getJobsLock(); e != nil {
+			return
+		}
+		defer releaseJobsLock()
+	}
+	znodes, err := jobZnodes()
+	if err != nil {
+		return 0, err
+	}
+	for _, znode := range znodes {
+		if b, err := store.Get(znode); err == ErrNoNode {
+			continue
+		} else if err != nil {
+			return legacy, fmt.Errorf("Can't fetch %s: %s", znode, err.Error())
+		} else if _, err = Deserialize(b); err != nil {
+			if err = quarantine(znode, b, err); err != nil {
+				return legacy, err
+			}
+		} else if IsLegacyJob(b) {
+			legacy++
+		}
+	}
+	return
+}
+
+// Get the quarantined znodes, oldest first, of jobs matching a name as ListJobs() does; an
+// empty name also matches a quarantined /nextjob
+func ListQuarantine(name string) (quarantined []*QuarantinedJob, e error) {
+	var rxJobnames *regexp.Regexp
+	if strings.Index(name, "*") != -1 {
+		if rxJobnames, e = regexp.Compile(strings.Replace(name, "*", ".*", -1)); e != nil {
+			return nil, fmt.Errorf("Invalid jobname mask: %s", e.Error())
+		}
+	}
+	quarantined = []*QuarantinedJob{}
+	e = walkQuarantine(PATH_QUARANTINE, func(q *QuarantinedJob) {
+		if name == "" || (rxJobnames != nil && rxJobnames.MatchString(q.Name())) || q.Name() == name {
+			quarantined = append(quarantined, q)
+		}
+	})
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i].Time.Before(quarantined[j].Time) })
+	return
+}
+
+// Call a function for each quarantined znode under a znode of /quarantine
+func walkQuarantine(znode string, f func(*QuarantinedJob)) error {
+	children, err := store.Children(znode)
+	if err == ErrNoNode {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to list %s: %s", znode, err.Error())
+	}
+	if len(children) == 0 && znode != PATH_QUARANTINE {
+		q := &QuarantinedJob{}
+		if b, err := store.Get(znode); err == ErrNoNode {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Can't fetch %s: %s", znode, err.Error())
+		} else if len(b) == 0 {
+			return nil // A parent whose quarantined znodes have been deleted
+		} else if err = gobDecode(b, q); err != nil {
+			return fmt.Errorf("Unable to decode quarantine record %s: %s", znode, err.Error())
+		}
+		f(q)
+	}
+	for _, child := range children {
+		if err = walkQuarantine(znode+"/"+child, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
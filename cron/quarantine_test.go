@@ -0,0 +1,158 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeserializeError(t *testing.T) {
+	for _, b := range []string{`{"version":1,"job":`, `{"version":1,"job":{}}`, "\x01garbage"} {
+		if job, err := Deserialize([]byte(b)); err == nil {
+			t.Errorf("Deserialized %q as %+v", b, job)
+		} else if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("Error %T deserializing %q isn't a DecodeError", err, b)
+		}
+	}
+	if job, err := Deserialize(nil); err != nil || job.Name != NULL_JOBNAME {
+		t.Errorf("Empty data deserialized as %+v: %v", job, err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	useMemoryStore(t)
+	if err := (&ClusterConfig{JobSchema: JOB_SCHEMA_VERSION}).Save(); err != nil {
+		t.Fatalf("Can't write jobs as JSON: %s", err.Error())
+	}
+	addJob(t, &Job{Name: "good", Schedule: "@hourly", Cmd: "true"})
+	store.Create(PATH_JOBS+"/bad", []byte(`{"version":1,"job":{"Name":`), false)
+
+	if err := setNextjob(); err != nil {
+		t.Fatalf("Can't schedule around bad job: %s", err.Error())
+	} else if b, err := store.Get(PATH_NEXT_JOB); err != nil {
+		t.Fatalf("Can't get nextjob: %s", err.Error())
+	} else if job, err := Deserialize(b); err != nil || job.Name != "good" {
+		t.Errorf("Next job is %+v (%v); expected good", job, err)
+	}
+	if exists, _ := store.Exists(PATH_JOBS + "/bad"); exists {
+		t.Errorf("Bad job left in %s", PATH_JOBS)
+	}
+	if jobs, err := ListJobs(""); err != nil || len(jobs) != 1 || jobs[0].Name != "good" {
+		t.Errorf("Unexpected job list %v: %v", jobs, err)
+	}
+
+	// A corrupted /nextjob is found by the doctor command's scan and rebuilt
+	store.Set(PATH_NEXT_JOB, []byte("garbage"))
+	if legacy, err := CheckJobs(); err != nil || legacy != 0 {
+		t.Errorf("Check found %d legacy jobs: %v", legacy, err)
+	}
+	if quarantined, err := ListQuarantine(""); err != nil || len(quarantined) != 2 {
+		t.Errorf("Unexpected quarantine list %v: %v", quarantined, err)
+	} else if quarantined[0].Path != PATH_JOBS+"/bad" || quarantined[0].Name() != "bad" ||
+		string(quarantined[1].Data) != "garbage" || quarantined[1].Name() != "" || quarantined[1].Err == "" {
+		t.Errorf("Unexpected quarantined znodes %+v %+v", quarantined[0], quarantined[1])
+	}
+	if b, _ := store.Get(PATH_NEXT_JOB); IsLegacyJob(b) {
+		t.Errorf("Next job not rebuilt: %s", b)
+	}
+	if quarantined, err := ListQuarantine("b*"); err != nil || len(quarantined) != 1 {
+		t.Errorf("Unexpected quarantine list for b*: %v %v", quarantined, err)
+	} else if err = quarantined[0].Clear(); err != nil {
+		t.Errorf("Can't clear quarantined job: %s", err.Error())
+	} else if quarantined, err = ListQuarantine("b*"); err != nil || len(quarantined) != 0 {
+		t.Errorf("Cleared job still quarantined: %v %v", quarantined, err)
+	}
+}
+
+func TestListSkipsUndecodable(t *testing.T) {
+	useMemoryStore(t)
+	addJob(t, &Job{Name: "good", Schedule: "@hourly", Cmd: "true"})
+	for _, root := range []string{PATH_JOBS, PATH_ARCHIVE} {
+		store.Create(root+"/bad", []byte("\x01garbage"), false)
+	}
+
+	// Listing neither waits for the lock held by another session nor moves the bad jobs
+	other := store.(*MemoryStore).NewSession()
+	defer other.Close()
+	lock := other.NewLock(PATH_JOBLOCK)
+	if err := lock.Lock(); err != nil {
+		t.Fatalf("Can't get lock: %s", err.Error())
+	}
+	defer lock.Unlock()
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		if jobs, err := ListJobs(""); err != nil || len(jobs) != 1 || jobs[0].Name != "good" {
+			t.Errorf("Unexpected job list %v: %v", jobs, err)
+		}
+		if jobs, err := ListArchive(""); err != nil || len(jobs) != 0 {
+			t.Errorf("Unexpected archive list %v: %v", jobs, err)
+		}
+	}()
+	select {
+	case <-listed:
+	case <-time.After(time.Second):
+		t.Fatalf("Listing jobs waited for the lock")
+	}
+	for _, root := range []string{PATH_JOBS, PATH_ARCHIVE} {
+		if exists, _ := store.Exists(root + "/bad"); !exists {
+			t.Errorf("Listing moved bad job out of %s", root)
+		}
+	}
+	if quarantined, err := ListQuarantine(""); err != nil || len(quarantined) != 0 {
+		t.Errorf("Listing quarantined %v: %v", quarantined, err)
+	}
+}
+
+func TestServerQuarantinesUndecodable(t *testing.T) {
+	useMemoryStore(t)
+	tick := time.Now().Truncate(time.Second)
+	broadcastPath := PATH_BROADCAST + "/bad"
+	tickPath := broadcastPath + "/" + broadcastTickName(tick)
+	tests := []struct {
+		name  string
+		setup []string // Znodes created along with the bad job
+		check func()
+		gone  []string // Znodes expected to be deleted
+	}{
+		{"recoverOrphans", []string{PATH_INFLIGHT + "/bad", PATH_INFLIGHT + "/bad/run1"}, func() {
+			if err := recoverOrphans(); err != nil {
+				t.Errorf("Can't recover orphans: %s", err.Error())
+			}
+		}, []string{PATH_INFLIGHT + "/bad/run1"}},
+		{"requestRetry", nil, func() {
+			(&Job{Name: "bad", MaxRetries: 2}).requestRetry(&RunRecord{})
+			(<-lockedRequests)()
+		}, nil},
+		{"requestRetire", nil, func() {
+			(&Job{Name: "bad"}).requestRetire()
+			(<-lockedRequests)()
+		}, nil},
+		{"finishBroadcast", []string{broadcastPath, tickPath}, func() {
+			if err := finishBroadcast("bad", tick); err != nil {
+				t.Errorf("Can't finish broadcast: %s", err.Error())
+			}
+		}, []string{broadcastPath}},
+		{"checkBroadcasts", []string{broadcastPath, tickPath}, func() {
+			if err := checkBroadcasts(); err != nil {
+				t.Errorf("Can't check broadcasts: %s", err.Error())
+			}
+		}, []string{broadcastPath}},
+	}
+	for _, test := range tests {
+		store.Create(PATH_JOBS+"/bad", []byte("\x01garbage"), false)
+		for _, znode := range test.setup {
+			store.Create(znode, []byte{}, false)
+		}
+		test.check()
+		for _, znode := range append(test.gone, PATH_JOBS+"/bad") {
+			if exists, _ := store.Exists(znode); exists {
+				t.Errorf("%s: %s left behind", test.name, znode)
+			}
+		}
+		if quarantined, err := ListQuarantine("bad"); err != nil || len(quarantined) != 1 {
+			t.Errorf("%s: unexpected quarantine list %v: %v", test.name, quarantined, err)
+		} else {
+			quarantined[0].Clear()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package cron
+
+import (
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+/*
+Finish starting this server by running the @reboot jobs if it's starting the
+cluster, and then marking it as started in /servers/<servername>.  The cluster
+is starting if no other server has been marked as started.  The caller must hold
+the lock, which ensures only the first of several servers starting together
+runs the @reboot jobs.
+*/
+func startServer() error {
+	servers, err := getServers()
+	if err != nil {
+		return err
+	}
+	clusterStart := true
+	for _, info := range servers {
+		if info.Name != serverName && info.Started {
+			clusterStart = false
+		}
+	}
+	if clusterStart {
+		runRebootJobs()
+	}
+	return localServerInfo(true).save()
+}
+
+// Schedule every @reboot job to run now.  The caller must hold the lock.
+func runRebootJobs() {
+	jobs, err := ListJobs("")
+	if err != nil {
+		log.Error.Printf("Unable to run @reboot jobs: %s", err.Error())
+		return
+	}
+	for _, job := range jobs {
+		if !job.Reboot() || job.HasError || job.Paused {
+			continue
+		}
+		job.NextRuntime = time.Now()
+		if err = job.UpdateZk(); err != nil {
+			log.Error.Println(err.Error())
+		} else {
+			log.Info.Printf("Cluster starting; scheduled @reboot job %s", job.Name)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cron
+
+import (
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+const (
+	DEFAULT_RETRY_DELAY = time.Minute     // Default wait before the first retry of a failed job
+	RETRY_DEFERRAL      = 5 * time.Second // How long the server where a job failed leaves its retry to other servers
+)
+
+// Return the wait before a retry attempt, which doubles with each attempt up to RetryMaxDelay
+func (job *Job) retryDelay(attempt int) time.Duration {
+	delay := job.RetryDelay
+	if delay <= 0 {
+		delay = DEFAULT_RETRY_DELAY
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if job.RetryMaxDelay > 0 && delay >= job.RetryMaxDelay {
+			return job.RetryMaxDelay
+		}
+	}
+	if job.RetryMaxDelay > 0 && delay > job.RetryMaxDelay {
+		delay = job.RetryMaxDelay
+	}
+	return delay
+}
+
+/*
+Ask the server loop to schedule a retry of a failed run.  The retry is
+rescheduled through /jobs/<jobname> and /nextjob by setting the job's next
+runtime to the backoff time, provided that's earlier than its next regular run.
+A one-shot job that isn't retried is retired.
+*/
+func (job *Job) requestRetry(record *RunRecord) {
+	attempt := job.Attempt + 1
+	if attempt > job.MaxRetries {
+		if job.MaxRetries > 0 {
+			log.Warning.Printf("Job %s failed after %d retries; giving up until its next scheduled run", job.Name, job.MaxRetries)
+		}
+		if job.OneShot() {
+			job.requestRetire()
+		}
+		return
+	}
+	submitLocked(func() {
+		current, err := getJob(job.Name)
+		if err != nil {
+			log.Warning.Printf("Unable to retry job %s: %s", job.Name, err.Error())
+			return
+		}
+		retryTime := time.Now().Add(current.retryDelay(attempt))
+		if current.HasError || current.Paused {
+			log.Warning.Printf("Not retrying job %s as it has an error or is paused", job.Name)
+		} else if !current.NextRuntime.IsZero() && !retryTime.Before(current.NextRuntime) {
+			log.Info.Printf("Not retrying job %s as its next run at %s precedes retry time", job.Name, current.FmtNextRuntime())
+		} else {
+			current.Attempt = attempt
+			current.LastServer = record.Server
+			current.NextRuntime = retryTime
+			if err = current.UpdateZk(); err != nil {
+				log.Error.Println(err.Error())
+			} else {
+				log.Info.Printf("Retry %d of %d of job %s scheduled for %s", attempt, current.MaxRetries, job.Name, current.FmtNextRuntime())
+			}
+			return
+		}
+		if current.OneShot() && current.NextRuntime.IsZero() {
+			current.retire()
+		}
+	})
+}
+
+// Check whether this server should leave a retry to another server.  It does so for a short time
+// after the retry is due if the job failed on this server and other servers are running.
+func (job *Job) deferRetry(now time.Time) (wait time.Duration) {
+	if job.Attempt == 0 || job.LastServer != serverName {
+		return 0
+	} else if wait = job.NextRuntime.Add(RETRY_DEFERRAL).Sub(now); wait <= 0 {
+		return 0
+	} else if servers, err := store.Children(PATH_SERVERS); err != nil || len(servers) < 2 {
+		return 0
+	}
+	return wait
+}
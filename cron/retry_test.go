@@ -0,0 +1,33 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		delay    time.Duration
+		maxDelay time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{0, 0, 0, DEFAULT_RETRY_DELAY},
+		{0, 0, 1, DEFAULT_RETRY_DELAY},
+		{0, 0, 3, 4 * DEFAULT_RETRY_DELAY},
+		{10 * time.Second, 0, 0, 10 * time.Second},
+		{10 * time.Second, 0, 1, 10 * time.Second},
+		{10 * time.Second, 0, 2, 20 * time.Second},
+		{10 * time.Second, 0, 4, 80 * time.Second},
+		{10 * time.Second, time.Minute, 3, 40 * time.Second},
+		{10 * time.Second, time.Minute, 4, time.Minute},
+		{10 * time.Second, time.Minute, 1000, time.Minute},
+		{10 * time.Second, 5 * time.Second, 1, 5 * time.Second},
+	}
+	for _, test := range tests {
+		job := &Job{Name: "retry", RetryDelay: test.delay, RetryMaxDelay: test.maxDelay}
+		if got := job.retryDelay(test.attempt); got != test.expected {
+			t.Errorf("Retry delay %v, maximum %v, attempt %d is %v; expected %v", test.delay, test.maxDelay, test.attempt, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package cron
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+// Concurrency policies, which determine what happens when a job is due while a previous run is still active
+const (
+	CONCURRENCY_ALLOW   = "allow"   // Start a new run alongside the active one (the default)
+	CONCURRENCY_FORBID  = "forbid"  // Skip the new run
+	CONCURRENCY_REPLACE = "replace" // Kill the active run and start the new one
+)
+
+// Orphan policies, which determine what happens to a run orphaned when its server stops while it's running
+const (
+	ORPHANS_FAIL  = "fail"  // Record the run as failed (the default)
+	ORPHANS_RERUN = "rerun" // Record the run as failed and run the job again on another server
+)
+
+// Check that an orphan policy is valid
+func validOrphans(policy string) bool {
+	switch strings.ToLower(policy) {
+	case "", ORPHANS_FAIL, ORPHANS_RERUN:
+		return true
+	}
+	return false
+}
+
+// Check that a concurrency policy is valid
+func validConcurrency(policy string) bool {
+	switch strings.ToLower(policy) {
+	case "", CONCURRENCY_ALLOW, CONCURRENCY_FORBID, CONCURRENCY_REPLACE:
+		return true
+	}
+	return false
+}
+
+/*
+Apply the job's concurrency policy and, if the job should run, create the
+ephemeral znode /running/<jobname>/<runid> that marks the run as active
+anywhere in the cluster.  The caller must hold the lock, which ensures no
+other server starts a run of the job between the check and the creation.
+*/
+func (job *Job) prepareRun() (ok bool, e error) {
+	jobPath := fmt.Sprintf("%s/%s", PATH_RUNNING, job.Name)
+	if e = ensurePath(jobPath); e != nil {
+		return false, e
+	}
+	active, err := store.Children(jobPath)
+	if err != nil {
+		return false, fmt.Errorf("Unable to check active runs of job %s: %s", job.Name, err.Error())
+	}
+	if job.Broadcast && job.AdHoc == "" {
+		active = job.activeOnServer(active)
+	}
+	if len(active) > 0 {
+		switch strings.ToLower(job.Concurrency) {
+		case CONCURRENCY_FORBID:
+			log.Info.Printf("Skipping job %s as %d previous run(s) still active %v", job.Name, len(active), active)
+			if job.AdHoc != "" {
+				// Record the skipped ad-hoc run so the run command isn't left waiting for it
+				now := time.Now()
+				record := &RunRecord{RunID: job.AdHoc, Server: serverName, Start: now, End: now, AdHoc: true, ExitCode: -1,
+					Err: "Skipped as previous run still active"}
+				if err = job.saveHistory(record); err != nil {
+					log.Error.Println(err.Error())
+				}
+			}
+			return false, nil
+
+		case CONCURRENCY_REPLACE:
+			for _, runID := range active {
+				// The server running the job watches its marker and kills the job when it's deleted.
+				// Its in-flight record goes first so the run isn't mistaken for an orphan.
+				log.Info.Printf("Replacing active run %s of job %s", runID, job.Name)
+				store.Delete(fmt.Sprintf("%s/%s/%s", PATH_INFLIGHT, job.Name, runID))
+				if err = store.Delete(fmt.Sprintf("%s/%s", jobPath, runID)); err != nil && err != ErrNoNode {
+					log.Warning.Printf("Unable to stop active run %s of job %s: %s", runID, job.Name, err.Error())
+				}
+			}
+		}
+	}
+
+	job.runStart = time.Now()
+	if job.AdHoc != "" {
+		job.runID = job.AdHoc // The run command waits for history under the id it was given
+	} else {
+		job.runID = newRunID(job.runStart)
+	}
+	record := &RunRecord{RunID: job.runID, Server: serverName, Start: job.runStart, AdHoc: job.AdHoc != ""}
+	if b, err := gobEncode(record); err != nil {
+		return false, fmt.Errorf("Unable to serialize run of job %s: %s", job.Name, err.Error())
+	} else if err = ensurePath(fmt.Sprintf("%s/%s", PATH_INFLIGHT, job.Name)); err != nil {
+		return false, err
+	} else if err = store.Create(job.inflightPath(), b, false); err != nil {
+		return false, fmt.Errorf("Unable to record start of job %s: %s", job.Name, err.Error())
+	}
+	if err = store.Create(job.runningPath(), []byte(serverName), true); err != nil {
+		store.Delete(job.inflightPath())
+		return false, fmt.Errorf("Unable to mark job %s as running: %s", job.Name, err.Error())
+	}
+	return true, nil
+}
+
+// Return the active runs of a broadcast job that are on this server, as each server runs it independently
+func (job *Job) activeOnServer(active []string) []string {
+	local := []string{}
+	for _, runID := range active {
+		if b, err := store.Get(fmt.Sprintf("%s/%s/%s", PATH_RUNNING, job.Name, runID)); err == nil && string(b) == serverName {
+			local = append(local, runID)
+		}
+	}
+	return local
+}
+
+// Return the path of this run's marker /running/<jobname>/<runid>
+func (job *Job) runningPath() string {
+	return fmt.Sprintf("%s/%s/%s", PATH_RUNNING, job.Name, job.runID)
+}
+
+// Return the path of this run's in-flight record /inflight/<jobname>/<runid>
+func (job *Job) inflightPath() string {
+	return fmt.Sprintf("%s/%s/%s", PATH_INFLIGHT, job.Name, job.runID)
+}
+
+// Close the stop channel if this run's marker is deleted before the done channel is closed
+func (job *Job) watchRunning(stop chan<- struct{}, done <-chan struct{}) {
+	for {
+		exists, watch, err := store.ExistsW(job.runningPath())
+		if err != nil {
+			log.Warning.Printf("Unable to watch run %s of job %s: %s", job.runID, job.Name, err.Error())
+			return
+		} else if !exists {
+			close(stop)
+			return
+		}
+		select {
+		case evt := <-watch:
+			if evt.Err != nil {
+				log.Warning.Printf("Error watching run %s of job %s: %s", job.runID, job.Name, evt.Err.Error())
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Delete this run's in-flight record and marker, in that order so the run is never seen as orphaned
+func (job *Job) finishRunning() {
+	if err := store.Delete(job.inflightPath()); err != nil && err != ErrNoNode {
+		log.Warning.Printf("Unable to clear in-flight record of job %s: %s", job.Name, err.Error())
+	}
+	if err := store.Delete(job.runningPath()); err != nil && err != ErrNoNode {
+		log.Warning.Printf("Unable to clear running marker of job %s: %s", job.Name, err.Error())
+	}
+}
+
+/*
+Find runs orphaned by a server that stopped while running them and apply
+each job's orphan policy.  An orphaned run has an in-flight record in
+/inflight/<jobname>/<runid> but no ephemeral marker in /running/<jobname>/<runid>,
+which vanished with the server's session.  The caller must hold the lock, which
+ensures only one server recovers each orphan.
+*/
+func recoverOrphans() error {
+	jobnames, err := store.Children(PATH_INFLIGHT)
+	if err != nil {
+		return fmt.Errorf("Unable to check for orphaned runs: %s", err.Error())
+	}
+	for _, jobname := range jobnames {
+		runIDs, err := store.Children(fmt.Sprintf("%s/%s", PATH_INFLIGHT, jobname))
+		if err != nil {
+			return fmt.Errorf("Unable to check for orphaned runs of job %s: %s", jobname, err.Error())
+		}
+		for _, runID := range runIDs {
+			orphan := &Job{Name: jobname, runID: runID}
+			if exists, err := store.Exists(orphan.runningPath()); err != nil {
+				return fmt.Errorf("Unable to check run %s of job %s: %s", runID, jobname, err.Error())
+			} else if !exists {
+				recoverOrphan(orphan)
+			}
+		}
+	}
+	return nil
+}
+
+// Record a run orphaned by a stopped server as failed and rerun the job if its policy says to
+func recoverOrphan(orphan *Job) {
+	record := &RunRecord{RunID: orphan.runID}
+	if b, err := store.Get(orphan.inflightPath()); err != nil {
+		log.Warning.Printf("Unable to fetch orphaned run %s of job %s: %s", orphan.runID, orphan.Name, err.Error())
+		return
+	} else if err = gobDecode(b, record); err != nil {
+		log.Warning.Printf("Unable to decode orphaned run %s of job %s: %s", orphan.runID, orphan.Name, err.Error())
+	}
+	if err := store.Delete(orphan.inflightPath()); err != nil {
+		log.Warning.Printf("Unable to clear orphaned run %s of job %s: %s", orphan.runID, orphan.Name, err.Error())
+		return
+	}
+	record.End = time.Now()
+	record.ExitCode = -1
+	record.Err = fmt.Sprintf("Server %s stopped while job was running", record.Server)
+	log.Warning.Printf("Run %s of job %s orphaned as server %s stopped while it was running", orphan.runID, orphan.Name, record.Server)
+	if err := orphan.saveHistory(record); err != nil {
+		log.Error.Println(err.Error())
+	}
+
+	job, err := getJob(orphan.Name)
+	if err != nil {
+		log.Trace.Printf("Orphaned job %s no longer exists: %s", orphan.Name, err.Error())
+	} else if strings.ToLower(job.Orphans) == ORPHANS_RERUN && !job.HasError && !job.Paused && !job.Broadcast {
+		log.Info.Printf("Rerunning orphaned job %s", orphan.Name)
+		if !job.placeableOn(localServerInfo(true)) {
+			// Leave the rerun to a server that matches the job's placement constraints
+			if _, err := job.RunNow(); err != nil {
+				log.Error.Println(err.Error())
+			}
+		} else if ok, err := job.prepareRun(); err != nil {
+			log.Error.Println(err.Error())
+		} else if ok {
+			go job.Run()
+		}
+	} else if job.OneShot() && job.NextRuntime.IsZero() {
+		job.retire()
+	}
+}
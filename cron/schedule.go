@@ -0,0 +1,174 @@
+package cron
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+)
+
+const (
+	CRON_TZ_PREFIX  = "CRON_TZ=" // Schedule prefix specifying the job's time zone, e.g. "CRON_TZ=Europe/Paris 0 9 * * *"
+	SCHEDULE_EVERY  = "@every"   // Schedule prefix for a fixed interval, e.g. "@every 90s"
+	SCHEDULE_REBOOT = "@reboot"  // Schedule that runs the job when the cluster starts
+	SCHEDULE_NONE   = "-"        // Schedule of a job that runs only when triggered, e.g. by a dependency
+	MIN_INTERVAL    = time.Second
+	PERIOD_SAMPLES  = 16 // Number of gaps between runs of a cron expression checked for its shortest
+)
+
+// Schedule aliases not known to cronexpr, which handles @yearly, @annually, @monthly, @weekly, @daily, and @hourly
+var scheduleAliases = map[string]string{
+	"@midnight": "@daily",
+}
+
+// Split a schedule string into its optional CRON_TZ= time zone and cron expression
+func splitSchedule(schedule string) (tz, expr string) {
+	schedule = strings.TrimSpace(schedule)
+	if strings.HasPrefix(schedule, CRON_TZ_PREFIX) {
+		fields := strings.SplitN(schedule[len(CRON_TZ_PREFIX):], " ", 2)
+		tz = fields[0]
+		if len(fields) > 1 {
+			expr = strings.TrimSpace(fields[1])
+		}
+		return
+	}
+	return "", schedule
+}
+
+// Return the time zone of a job's schedule, from its TZ field or a CRON_TZ= schedule prefix.
+// A job with neither uses the local time zone of the server that calculates its next runtime.
+func (job *Job) location() (*time.Location, error) {
+	tz, _ := splitSchedule(job.Schedule)
+	if tz != "" && job.TZ != "" && tz != job.TZ {
+		return nil, fmt.Errorf("Time zone %s of job %s conflicts with %s%s in its schedule", job.TZ, job.Name, CRON_TZ_PREFIX, tz)
+	} else if tz == "" {
+		tz = job.TZ
+	}
+	if tz == "" {
+		return time.Local, nil
+	} else if loc, err := time.LoadLocation(tz); err != nil {
+		return nil, fmt.Errorf("Invalid time zone \"%s\" for job %s: %s", tz, job.Name, err.Error())
+	} else {
+		return loc, nil
+	}
+}
+
+// Check whether a job runs when the cluster starts rather than at scheduled times
+func (job *Job) Reboot() bool {
+	_, expr := splitSchedule(job.Schedule)
+	return expr == SCHEDULE_REBOOT
+}
+
+// Return the interval of an "@every <duration>" schedule, or 0 if it's not one
+func (job *Job) interval() (time.Duration, error) {
+	_, expr := splitSchedule(job.Schedule)
+	if !strings.HasPrefix(expr, SCHEDULE_EVERY+" ") {
+		return 0, nil
+	} else if interval, err := time.ParseDuration(strings.TrimSpace(expr[len(SCHEDULE_EVERY):])); err != nil {
+		return 0, fmt.Errorf("Invalid interval in schedule string \"%s\" for job %s: %s", job.Schedule, job.Name, err.Error())
+	} else if interval < MIN_INTERVAL {
+		return 0, fmt.Errorf("Interval %v of job %s is less than the minimum of %v", interval, job.Name, MIN_INTERVAL)
+	} else {
+		return interval, nil
+	}
+}
+
+/*
+Return the shortest time between a job's runs, or 0 if it doesn't run on a
+schedule.  For an @every job this is its interval.  The gaps between the runs
+of a cron expression vary, as for "0 9 * * 1-5", so for those it's the shortest
+of the gaps between its next PERIOD_SAMPLES runs.
+*/
+func (job *Job) period() (period time.Duration, e error) {
+	if interval, err := job.interval(); err != nil || interval > 0 {
+		return interval, err
+	}
+	prev, err := job.nextRuntimeAfter(time.Now())
+	for i := 0; i < PERIOD_SAMPLES && err == nil && !prev.IsZero(); i++ {
+		var next time.Time
+		if next, err = job.nextRuntimeAfter(prev); err == nil && !next.IsZero() && (period == 0 || next.Sub(prev) < period) {
+			period = next.Sub(prev)
+		}
+		prev = next
+	}
+	return period, err
+}
+
+/*
+Calculate the first time after a given time that a job's schedule calls for it to run.
+A zero time means the job has no run after that time, as for a one-shot job that's due,
+an @reboot job, or a job that's only triggered.  An @every job runs at multiples of its interval after its anchor,
+so its runs don't drift with run duration or with how late the server reschedules it.
+*/
+func (job *Job) nextRuntimeAfter(from time.Time) (time.Time, error) {
+	if job.OneShot() {
+		if job.At.After(from) {
+			return job.At, nil
+		}
+		return time.Time{}, nil
+	} else if _, expr := splitSchedule(job.Schedule); job.Reboot() || expr == SCHEDULE_NONE {
+		return time.Time{}, nil
+	}
+	loc, err := job.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if interval, err := job.interval(); err != nil {
+		return time.Time{}, err
+	} else if interval > 0 {
+		anchor := job.Anchor
+		if anchor.IsZero() {
+			anchor = from
+		}
+		next := anchor.Add(from.Sub(anchor) / interval * interval)
+		for !next.After(from) {
+			next = next.Add(interval)
+		}
+		return next, nil
+	}
+	_, expr := splitSchedule(job.Schedule)
+	if alias, ok := scheduleAliases[expr]; ok {
+		expr = alias
+	}
+	cronSchedule, err := cronexpr.Parse(expr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid schedule string \"%s\" for job %s: %s", job.Schedule, job.Name, err.Error())
+	}
+	return nextInLocation(cronSchedule, from, loc), nil
+}
+
+/*
+Return the first time after from that matches a cron expression on the wall
+clock of a location.  cronexpr does its arithmetic in the location of the time
+it's given, and loops or goes backwards across daylight saving transitions, so
+we give it wall clock times in UTC and convert its result back to the location:
+
+  - A wall clock time skipped when clocks spring forward runs the same amount
+    of time after the transition, e.g. 02:30 runs at 03:30 when 02:00 becomes 03:00.
+  - A wall clock time repeated when clocks fall back runs once, at its first
+    occurrence.
+
+A zero time means the expression has no time after from.
+*/
+func nextInLocation(expr *cronexpr.Expression, from time.Time, loc *time.Location) time.Time {
+	wall := wallClock(from.In(loc))
+	for {
+		if wall = expr.Next(wall); wall.IsZero() {
+			return wall
+		}
+		next := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+		if skipped := wall.Sub(wallClock(next)); skipped > 0 {
+			// time.Date resolved a time in a spring-forward gap to before the gap
+			next = next.Add(skipped)
+		}
+		if next.After(from) {
+			return next
+		}
+	}
+}
+
+// Return a time with the same wall clock reading in UTC
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,211 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+// Check a sequence of runtimes calculated from a starting time
+func checkRuntimes(t *testing.T, job *Job, from time.Time, expected ...string) {
+	loc, err := job.location()
+	if err != nil {
+		t.Fatalf("Job %s: %s", job.Name, err.Error())
+	}
+	for _, want := range expected {
+		next, err := job.nextRuntimeAfter(from)
+		if err != nil {
+			t.Fatalf("Job %s: %s", job.Name, err.Error())
+		}
+		if got := next.In(loc).Format("2006-01-02 15:04:05 MST"); got != want {
+			t.Fatalf("Job %s: next runtime after %s is %s; expected %s", job.Name, from.In(loc), got, want)
+		}
+		from = next
+	}
+}
+
+func TestNextRuntimeTZ(t *testing.T) {
+	from := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	checkRuntimes(t, &Job{Name: "ny", TZ: "America/New_York", Schedule: "0 9 * * *"}, from,
+		"2026-06-01 09:00:00 EDT", "2026-06-02 09:00:00 EDT")
+	checkRuntimes(t, &Job{Name: "tokyo", TZ: "Asia/Tokyo", Schedule: "0 9 * * *"}, from,
+		"2026-06-02 09:00:00 JST", "2026-06-03 09:00:00 JST")
+}
+
+func TestNextRuntimeCronTZPrefix(t *testing.T) {
+	from := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	checkRuntimes(t, &Job{Name: "prefix", Schedule: "CRON_TZ=Europe/Paris 30 8 * * *"}, from,
+		"2026-06-02 08:30:00 CEST")
+	checkRuntimes(t, &Job{Name: "both", TZ: "Europe/Paris", Schedule: "CRON_TZ=Europe/Paris 30 8 * * *"}, from,
+		"2026-06-02 08:30:00 CEST")
+
+	job := &Job{Name: "conflict", TZ: "America/New_York", Schedule: "CRON_TZ=Europe/Paris 30 8 * * *"}
+	if _, err := job.nextRuntimeAfter(from); err == nil {
+		t.Errorf("Job %s: expected error for conflicting time zones", job.Name)
+	}
+	job = &Job{Name: "invalid", Schedule: "CRON_TZ=Not/AZone 30 8 * * *"}
+	if err := job.Validate(); err == nil {
+		t.Errorf("Job %s: expected error for invalid time zone", job.Name)
+	}
+}
+
+func TestNextRuntimeSpringForward(t *testing.T) {
+	// Clocks in New York go from 02:00 EST to 03:00 EDT on 2026-03-08
+	from := time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC)
+	checkRuntimes(t, &Job{Name: "daily-in-gap", TZ: "America/New_York", Schedule: "30 2 * * *"}, from,
+		"2026-03-08 03:30:00 EDT", "2026-03-09 02:30:00 EDT")
+	checkRuntimes(t, &Job{Name: "daily-after-gap", TZ: "America/New_York", Schedule: "30 3 * * *"}, from,
+		"2026-03-08 03:30:00 EDT", "2026-03-09 03:30:00 EDT")
+
+	from = time.Date(2026, 3, 8, 1, 15, 0, 0, mustLoadLocation(t, "America/New_York"))
+	checkRuntimes(t, &Job{Name: "half-hourly", TZ: "America/New_York", Schedule: "*/30 * * * *"}, from,
+		"2026-03-08 01:30:00 EST", "2026-03-08 03:00:00 EDT", "2026-03-08 03:30:00 EDT", "2026-03-08 04:00:00 EDT")
+}
+
+func TestNextRuntimeFallBack(t *testing.T) {
+	// Clocks in New York go from 02:00 EDT back to 01:00 EST on 2026-11-01
+	from := time.Date(2026, 10, 31, 12, 0, 0, 0, time.UTC)
+	checkRuntimes(t, &Job{Name: "daily-in-overlap", TZ: "America/New_York", Schedule: "30 1 * * *"}, from,
+		"2026-11-01 01:30:00 EDT", "2026-11-02 01:30:00 EST")
+
+	from = time.Date(2026, 11, 1, 0, 45, 0, 0, mustLoadLocation(t, "America/New_York"))
+	checkRuntimes(t, &Job{Name: "half-hourly", TZ: "America/New_York", Schedule: "*/30 * * * *"}, from,
+		"2026-11-01 01:00:00 EDT", "2026-11-01 01:30:00 EDT", "2026-11-01 02:00:00 EST", "2026-11-01 02:30:00 EST")
+
+	// A server calculating the next runtime during the repeated hour doesn't rerun the first occurrence
+	from = time.Date(2026, 11, 1, 6, 10, 0, 0, time.UTC) // 01:10 EST
+	checkRuntimes(t, &Job{Name: "second-pass", TZ: "America/New_York", Schedule: "30 1 * * *"}, from,
+		"2026-11-02 01:30:00 EST")
+}
+
+func TestNextRuntimeEvery(t *testing.T) {
+	anchor := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	job := &Job{Name: "every", Schedule: "@every 90s", Anchor: anchor}
+	checkRuntimes(t, job, anchor, "2026-06-01 12:01:30 UTC", "2026-06-01 12:03:00 UTC")
+
+	// A late reschedule keeps to the anchor's intervals
+	checkRuntimes(t, job, anchor.Add(100*time.Second), "2026-06-01 12:03:00 UTC")
+
+	for _, schedule := range []string{"@every 0s", "@every 500ms", "@every fortnight"} {
+		job = &Job{Name: "invalid", Schedule: schedule}
+		if _, err := job.nextRuntimeAfter(anchor); err == nil {
+			t.Errorf("Job %s: expected error for schedule %s", job.Name, schedule)
+		}
+	}
+}
+
+func TestNextRuntimeAliases(t *testing.T) {
+	from := time.Date(2026, 6, 1, 12, 30, 0, 0, time.UTC)
+	checkRuntimes(t, &Job{Name: "hourly", TZ: "UTC", Schedule: "@hourly"}, from, "2026-06-01 13:00:00 UTC")
+	checkRuntimes(t, &Job{Name: "daily", TZ: "UTC", Schedule: "@daily"}, from, "2026-06-02 00:00:00 UTC")
+	checkRuntimes(t, &Job{Name: "midnight", TZ: "UTC", Schedule: "@midnight"}, from, "2026-06-02 00:00:00 UTC")
+	checkRuntimes(t, &Job{Name: "weekly", TZ: "UTC", Schedule: "@weekly"}, from, "2026-06-07 00:00:00 UTC")
+	checkRuntimes(t, &Job{Name: "monthly", TZ: "UTC", Schedule: "@monthly"}, from, "2026-07-01 00:00:00 UTC")
+
+	job := &Job{Name: "reboot", Schedule: "@reboot"}
+	if next, err := job.nextRuntimeAfter(from); err != nil || !next.IsZero() {
+		t.Errorf("Job %s: next runtime is %s (%v); expected none", job.Name, next, err)
+	}
+}
+
+func TestNextRuntimeOneShot(t *testing.T) {
+	at := time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC)
+	job := &Job{Name: "once", At: at}
+	if next, err := job.nextRuntimeAfter(at.Add(-time.Hour)); err != nil || !next.Equal(at) {
+		t.Errorf("Job %s: next runtime before its time is %s (%v); expected %s", job.Name, next, err, at)
+	}
+	if next, err := job.nextRuntimeAfter(at); err != nil || !next.IsZero() {
+		t.Errorf("Job %s: next runtime at its time is %s (%v); expected none", job.Name, next, err)
+	}
+
+	job = &Job{Name: "past", At: time.Now().Add(-time.Minute)}
+	if err := job.Validate(); err == nil {
+		t.Errorf("Job %s: expected error for a time that has passed", job.Name)
+	}
+	job = &Job{Name: "scheduled", At: time.Now().Add(time.Hour), Schedule: "0 * * * *"}
+	if err := job.Validate(); err == nil {
+		t.Errorf("Job %s: expected error for a one-shot job with a schedule", job.Name)
+	}
+	job = &Job{Name: "retained", Schedule: "0 * * * *", Retain: time.Hour}
+	if err := job.Validate(); err == nil {
+		t.Errorf("Job %s: expected error for retention of a scheduled job", job.Name)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	useMemoryStore(t)
+	window := 10 * time.Minute
+	job := &Job{Name: "hashed", Schedule: "0 0 * * *", Jitter: window}
+	offset := job.jitterOffset()
+	if offset < 0 || offset >= window {
+		t.Fatalf("Job %s: offset %v outside jitter window %v", job.Name, offset, window)
+	}
+	if again := job.jitterOffset(); again != offset {
+		t.Errorf("Job %s: hash offset changed from %v to %v", job.Name, offset, again)
+	}
+	if _, err := job.SetNextRuntime(); err != nil {
+		t.Fatalf("Job %s: %s", job.Name, err.Error())
+	} else if got := job.NextRuntime.Sub(job.BaseRuntime); got != offset {
+		t.Errorf("Job %s: next runtime is %v after its scheduled time; expected %v", job.Name, got, offset)
+	}
+
+	job = &Job{Name: "random", Schedule: "0 0 * * *", Jitter: window, JitterMode: JITTER_RANDOM}
+	for i := 0; i < 10; i++ {
+		if offset := job.jitterOffset(); offset < 0 || offset >= window {
+			t.Fatalf("Job %s: offset %v outside jitter window %v", job.Name, offset, window)
+		}
+	}
+	job = &Job{Name: "none", Schedule: "0 0 * * *", Jitter: window, JitterMode: JITTER_NONE}
+	if offset := job.jitterOffset(); offset != 0 {
+		t.Errorf("Job %s: offset %v with jitter disabled", job.Name, offset)
+	}
+	for _, job := range []*Job{
+		{Name: "too-wide", Schedule: "@every 5m", Jitter: window},
+		{Name: "too-wide-cron", Schedule: "*/5 * * * *", Jitter: window},
+		{Name: "too-wide-hourly", Schedule: "0 * * * *", Jitter: 2 * time.Hour},
+		{Name: "too-wide-uneven", Schedule: "0 0,1 * * *", Jitter: 2 * time.Hour},
+	} {
+		job.Cmd = "true"
+		if err := job.Validate(); err == nil {
+			t.Errorf("Job %s: expected error for jitter wider than the time between runs", job.Name)
+		}
+	}
+	job = &Job{Name: "narrow-cron", Schedule: "0 * * * *", Cmd: "true", Jitter: window}
+	if err := job.Validate(); err != nil {
+		t.Errorf("Job %s: %s", job.Name, err.Error())
+	}
+
+	// A cluster default wider than the time between a job's runs is cut down to it
+	if err := (&ClusterConfig{Jitter: time.Hour}).Save(); err != nil {
+		t.Fatalf("Can't save configuration: %s", err.Error())
+	}
+	for _, job := range []*Job{
+		{Name: "inherited-every", Schedule: "@every 1m"},
+		{Name: "inherited-cron", Schedule: "* * * * *"},
+		{Name: "inherited-random", Schedule: "@every 1m", JitterMode: JITTER_RANDOM},
+	} {
+		for i := 0; i < 10; i++ {
+			if offset := job.jitterOffset(); offset < 0 || offset >= time.Minute {
+				t.Fatalf("Job %s: offset %v outside the minute between its runs", job.Name, offset)
+			}
+		}
+	}
+	job = &Job{Name: "inherited-daily", Schedule: "0 0 * * *"}
+	if offset := job.jitterOffset(); offset < 0 || offset >= time.Hour {
+		t.Errorf("Job %s: offset %v outside default jitter window %v", job.Name, offset, time.Hour)
+	}
+}
+
+func TestFmtNextRuntimeTZ(t *testing.T) {
+	job := &Job{Name: "fmt", TZ: "America/New_York", NextRuntime: time.Date(2026, 1, 15, 14, 0, 0, 0, time.UTC)}
+	if got := job.FmtNextRuntime(); got != "2026-01-15 09:00:00 EST" {
+		t.Errorf("Job %s: FmtNextRuntime() is %s", job.Name, got)
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Unable to load time zone %s: %s", name, err.Error())
+	}
+	return loc
+}
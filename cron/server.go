@@ -4,21 +4,28 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/samuel/go-zookeeper/zk"
 	log "github.com/tooda02/castle-cron/logging"
 )
 
 var (
-	lock *zk.Lock // Lock for /jobs
-	hasLock bool  // true => We have acquired the lock
+	lock           Locker                   // Lock for /jobs
+	hasLock        bool                     // true => We have acquired the lock
+	lockedRequests = make(chan func(), 100) // Work from running jobs to be done by Run() while holding the lock
 )
 
 /*
 Schedule and run jobs.  We do the following:
+0. If this server just started or another server stopped, take the lock and
+   recover any runs orphaned by a stopped server.  If this server is starting
+   the cluster, also schedule the @reboot jobs.  If a broadcast run has started
+   or a server has started or stopped, run this server's part of any broadcast runs.
+   Delete archived one-shot jobs whose retention has ended.
 1. Retrieve the next job scheduled from znode /nextjob and set a watch.
 2. If the job's execution time is in the future, set a timer and wait
    for either timer expiration or the watch event, and return to step 1.
-3. If the job is ready to run, request a lock on /jobs.
+3. If the job is ready to run and this server can run it, claim the run unless
+   another server is chosen to run it, and request a lock on /jobs.  A server
+   that doesn't claim the run releases the lock and waits for the claim.
 4. When the lock is granted, check if the job in /nextjob is still ready to run.
    If not, release the lock and return to step 2.
 5. Run the job.
@@ -29,14 +36,67 @@ func Run(name string, force bool) (e error) {
 	if e = setServerName(name, force); e != nil {
 		return fmt.Errorf("Unable to set server name: %s", e.Error())
 	}
-	reportServers()
-	
-	isRunning = true
-	for isRunning {
+	setRunning(true)
+	defer setRunning(false)
+	serverDone = make(chan struct{})
+	reportServers(serverDone)
+	watchBroadcasts(serverDone)
+
+	starting := true         // Run @reboot jobs if this server is starting the cluster
+	recoveryNeeded := true   // Recover runs orphaned while the cluster was down
+	rescheduleNeeded := true // Reschedule jobs whose placement depends on the servers running
+	broadcastNeeded := true  // Join broadcast runs in progress and finish any no longer waiting for a server
+	purgeNeeded := true      // Delete archived one-shot jobs whose retention has ended
+	requests := []func(){}
+	for isRunning() {
+
+		// 0. If a server has stopped, recover any runs it orphaned, and handle any
+		//    requests from completed jobs, such as retries.  If a server has started
+		//    or stopped, recalculate the schedule, as the jobs that can run have changed.
+		//    When an archived job's retention ends, purge it.
+
+		requests = drainLockedRequests(requests)
+		if starting || recoveryNeeded || rescheduleNeeded || broadcastNeeded || purgeNeeded || len(requests) > 0 {
+			if err := getJobsLock(); err != nil {
+				return err
+			}
+			if starting {
+				if err := startServer(); err != nil {
+					log.Error.Println(err.Error())
+				}
+				starting = false
+			}
+			if recoveryNeeded {
+				if err := recoverOrphans(); err != nil {
+					log.Error.Println(err.Error())
+				}
+				recoveryNeeded = false
+			}
+			if rescheduleNeeded {
+				if err := setNextjob(); err != nil {
+					log.Error.Println(err.Error())
+				}
+				rescheduleNeeded = false
+			}
+			if broadcastNeeded {
+				if err := checkBroadcasts(); err != nil {
+					log.Error.Println(err.Error())
+				}
+				broadcastNeeded = false
+			}
+			if purgeNeeded {
+				purgeArchive()
+				purgeNeeded = false
+			}
+			for _, request := range requests {
+				request()
+			}
+			requests = requests[:0]
+		}
 
 		// 1. Retrieve the next scheduled job.  This is always in /nextjob
 
-		jobData, _, watch, err := zkConn.GetW(PATH_NEXT_JOB)
+		jobData, watch, err := store.GetW(PATH_NEXT_JOB)
 		if err != nil {
 			releaseJobsLock()
 			return fmt.Errorf("Unable to retrieve next job: %s", err.Error())
@@ -44,8 +104,12 @@ func Run(name string, force bool) (e error) {
 		now := time.Now()
 		job, err := Deserialize(jobData)
 		if err != nil {
-			releaseJobsLock()
-			return fmt.Errorf("Unable to decode next job: %s", err.Error())
+			// Move the bad data aside and schedule from the jobs themselves
+			if err = quarantine(PATH_NEXT_JOB, jobData, err); err != nil {
+				releaseJobsLock()
+				return fmt.Errorf("Unable to replace undecodable next job: %s", err.Error())
+			}
+			continue
 		}
 
 		// 2. If the next job is in the future, wait until its scheduled
@@ -65,13 +129,99 @@ func Run(name string, force bool) (e error) {
 
 			case <-time.After(job.NextRuntime.Sub(now)):
 			log.Trace.Printf("Wait time expired - checking schedule")
+
+			case <-serversStopped:
+				log.Trace.Printf("Server stopped - checking for orphaned runs")
+				recoveryNeeded = true
+				rescheduleNeeded = true
+				broadcastNeeded = true
+				purgeNeeded = true // The server may have archived jobs
+
+			case <-serversStarted:
+				log.Trace.Printf("Server started - checking schedule")
+				rescheduleNeeded = true
+
+			case <-broadcastsChanged:
+				log.Trace.Printf("Broadcast runs changed - checking for runs to join")
+				broadcastNeeded = true
+
+			case request := <-lockedRequests:
+				requests = append(requests, request)
+
+			case <-purgeTimer():
+				log.Trace.Printf("Retention of an archived job ended - purging archive")
+				purgeNeeded = true
+			}
+			continue
+		}
+
+		// 3. If the job is ready to run but its placement constraints rule out this server,
+		//    leave it to the servers that can run it and wait for the schedule to change.
+
+		if !job.placeableOn(localServerInfo(true)) {
+			log.Trace.Printf("Leaving job %s to servers matching its placement constraints", job.Name)
+			if err = releaseJobsLock(); err != nil {
+				return err
+			}
+			select {
+			case <-watch:
+			case <-serversStopped:
+				recoveryNeeded = true
+				rescheduleNeeded = true
+				broadcastNeeded = true
+				purgeNeeded = true
+			case <-serversStarted:
+				rescheduleNeeded = true
+			case <-broadcastsChanged:
+				broadcastNeeded = true
+			case request := <-lockedRequests:
+				requests = append(requests, request)
+			case <-purgeTimer():
+				purgeNeeded = true
 			}
 			continue
 		}
 
-		// 3. If the job is ready to run and we don't have the lock, request it
+		//    If the job is ready to run, claim it unless the job's placement strategy
+		//    chose another server, in which case release the lock and leave the run to
+		//    that server while its claim stands.  A retry of a job that failed on this
+		//    server is likewise first left to other servers.  If we don't have the lock,
+		//    request it.
 		// 4. Once the lock is granted, continue to request the next job again.
 
+		claimed, wait, claimWatch, err := job.claimRun(now)
+		if err != nil {
+			releaseJobsLock()
+			return err
+		}
+		if !claimed {
+			if err = releaseJobsLock(); err != nil {
+				return err
+			}
+			var fallback <-chan time.Time
+			if wait > 0 {
+				fallback = time.After(wait)
+			}
+			select {
+			case <-watch:
+			case <-claimWatch:
+			case <-fallback:
+			case <-serversStopped:
+				recoveryNeeded = true
+				rescheduleNeeded = true
+				broadcastNeeded = true
+				purgeNeeded = true
+			case <-serversStarted:
+				rescheduleNeeded = true
+			case <-broadcastsChanged:
+				broadcastNeeded = true
+			case request := <-lockedRequests:
+				requests = append(requests, request)
+			case <-purgeTimer():
+				purgeNeeded = true
+			}
+			continue
+		}
 		if !hasLock {
 			if err := getJobsLock(); err != nil {
 				return err
@@ -79,50 +229,104 @@ func Run(name string, force bool) (e error) {
 			continue
 		}
 
-		// 5. Run the job.  We do this asynchronously so that we can release the lock
-		//    while the job continues to run.  Note that this means there's no recovery
-		//    if the job fails or the server crashes while it's running.
+		// 5. Run the job, subject to its misfire and concurrency policies.  We do this asynchronously
+		//    so that we can release the lock while the job continues to run.  If the
+		//    server crashes while it's running, the other servers recover it at step 0.
+		//    The job runs from a copy, as updateSchedule() changes its next runtime.
+		//    A broadcast job instead starts a run that every server joins.
 
-		go job.Run()
+		if job.Broadcast && job.AdHoc == "" {
+			if err := job.startBroadcast(now); err != nil {
+				return err
+			}
+			job.dropClaim()
+			continue
+		}
+		started := false
+		if job.AdHoc == "" && !job.applyMisfirePolicy(now) {
+			// Late run dropped by the job's misfire policy
+		} else if ok, err := job.prepareRun(); err != nil {
+			log.Error.Println(err.Error())
+		} else if ok {
+			job.PlacedOn = serverName
+			runJob := *job
+			go runJob.Run()
+			started = true
+		}
 
-		// 6. Determine runtime of the next job in the schedule and update /jobsnext
+		// 6. Determine runtime of the next job in the schedule and update /jobsnext.
+		//    An ad-hoc run is removed from the schedule rather than rescheduled.
+		//    The run's claim is then no longer needed.
 
-		if err := updateSchedule(job); err != nil {
+		if job.AdHoc != "" {
+			if err := finishAdhoc(job); err != nil {
+				return err
+			}
+		} else if err := updateSchedule(job, started); err != nil {
 			return err
 		}
+		job.dropClaim()
 
 	}
 	return nil
 }
 
-// Check whether a job just added, updated, or deleted affects nextjob
+// Queue work for Run() to do while holding the lock.  This is only for goroutines other than Run()'s,
+// such as those running jobs; Run() itself, which reads the queue, does the work directly.
+func submitLocked(request func()) {
+	lockedRequests <- request
+}
+
+// Add any queued requests to a list of requests for Run() to do while holding the lock
+func drainLockedRequests(requests []func()) []func() {
+	for {
+		select {
+		case request := <-lockedRequests:
+			requests = append(requests, request)
+		default:
+			return requests
+		}
+	}
+}
+
+// Check whether a job just added, updated, paused, resumed, or deleted affects nextjob
 // The caller must take the lock before calling this function
-func checkForNextjobUpdate(job *Job) (e error) {
-	newScheduleNeeded := false // Set when user deletes currently scheduled job
-	if b, _, err := zkConn.Get(PATH_NEXT_JOB); err != nil {
+func checkForNextjobUpdate(job *Job, deleted bool) (e error) {
+	newScheduleNeeded := false            // Set when user deletes or pauses currently scheduled job
+	removed := deleted || !job.Runnable() // Job can no longer be the next job
+	if !removed {
+		if servers, err := getServers(); err != nil {
+			return err
+		} else {
+			removed = !job.placeable(servers)
+		}
+	}
+	if b, err := store.Get(PATH_NEXT_JOB); err != nil {
 		return fmt.Errorf("Unable to check schedule after job update: %s", err.Error())
 	} else if nextjob, err := Deserialize(b); err != nil {
-		return err
+		return quarantine(PATH_NEXT_JOB, b, err) // Rebuilds /nextjob from the jobs, including this one
 	} else if nextjob.Name == NULL_JOBNAME {		
 		// Schedule is currently empty - add the job we just created
 		
-		if job.HasError {
-			// Uh-oh - nothing in the schedule and we just deleted a job
-			// This shouldn't ever happen; log an error and treat as first-time schedule
-			log.Error.Printf("Job delete succeeded, but schedule is currently empty")
+		if deleted {
+			// Nothing in the schedule and we just deleted a job, which is normal only if the
+			// job couldn't run, e.g. it was paused.  Treat as first-time schedule.
+			log.Trace.Printf("Job %s deleted while schedule is empty", job.Name)
 			newScheduleNeeded = true
+		} else if removed {
+			log.Trace.Printf("Job %s can't run, leaving schedule empty", job.Name)
 		} else if err := job.UpdateZkNextjob(); err != nil {
 			return err
 		} else {
 			log.Trace.Printf("Scheduled first job %s to start at %s", job.Name, job.FmtNextRuntime())
 		}
-	} else if job.HasError {
-		// User is deleting a job.  If it's the currently scheduled job, we need to reset the schedule.
+	} else if removed {
+		// User is deleting or pausing a job.  If it's the currently scheduled job, we need to reset the schedule.
 		if job.Name == nextjob.Name {
-			log.Trace.Printf("Next scheduled job %s deleted by update")
+			log.Trace.Printf("Next scheduled job %s removed from schedule by update", job.Name)
 			newScheduleNeeded = true
 		}
-	} else if job.Name == nextjob.Name || job.NextRuntime.Before(nextjob.NextRuntime) {
+	} else if (job.Name == nextjob.Name && job.AdHoc == nextjob.AdHoc) || job.NextRuntime.Before(nextjob.NextRuntime) {
 		// User has either updated the currently scheduled job, or created a new one that
 		// has an earlier runtime.  In either case, we need to update /nextjob with the new one.
 		if err := job.UpdateZkNextjob(); err != nil {
@@ -132,7 +336,7 @@ func checkForNextjobUpdate(job *Job) (e error) {
 		}
 	}
 	
-	// If user deleted the currently scheduled job, refresh it
+	// If user deleted or paused the currently scheduled job, refresh it
 	
 	if newScheduleNeeded {
 		e = setNextjob()
@@ -142,11 +346,51 @@ func checkForNextjobUpdate(job *Job) (e error) {
 
 // Reschedule current job and set the next scheduled job in /jobsnext
 // This function releases the /jobs lock; the caller is responsible for obtaining it.
-func updateSchedule(job *Job) error {
+func updateSchedule(job *Job, started bool) error {
 	defer releaseJobsLock()
+	if err := rescheduleJob(job, started); err != nil {
+		return err
+	}
+	return releaseJobsLock() // Explicit unlock to ensure logging of any error
+}
 
-	// Update the next run time of the job we just ran
+// Reschedule a job that's due and set the next scheduled job in /jobsnext.
+// The caller must hold the lock.
+func rescheduleJob(job *Job, started bool) error {
 
+	// Update the next run time of the job we just ran, which ends any retries
+
+	job.Attempt = 0
+	job.LastServer = ""
+	if job.OneShot() {
+		// A one-shot job has no next run.  It's retired when its run is over, or now if it didn't start.
+		job.CatchUp = 0
+		job.NextRuntime = time.Time{}
+		if !started {
+			job.retire()
+		} else if err := job.UpdateZk(); err != nil {
+			log.Error.Println(err.Error())
+		} else {
+			log.Info.Printf("One-shot job %s has run", job.Name)
+		}
+		purgeArchive()
+		return setNextjob()
+	}
+	if job.CatchUp > 1 {
+		// Catching up on missed runs - schedule the next missed occurrence
+		job.CatchUp--
+		if next, err := job.nextRuntimeAfter(job.NextRuntime); err == nil && !next.IsZero() && next.Before(time.Now()) {
+			job.NextRuntime = next
+			job.BaseRuntime = next
+			if err = job.UpdateZk(); err != nil {
+				log.Error.Println(err.Error())
+			} else {
+				log.Info.Printf("Job %s catching up missed run at %s", job.Name, job.FmtNextRuntime())
+			}
+			return setNextjob()
+		}
+	}
+	job.CatchUp = 0
 	if changed, err := job.SetNextRuntime(); err != nil {
 		log.Error.Printf("Can't reschedule job %s: %s", job.Name, err.Error())
 		job.HasError = true
@@ -154,46 +398,76 @@ func updateSchedule(job *Job) error {
 		log.Error.Printf("Attempt to reschedule job %s failed as no new run time available", job.Name)
 		job.HasError = true
 	} else if err = job.UpdateZk(); err != nil {
-		log.Error.Printf(err.Error())
+		log.Error.Println(err.Error())
+	} else if job.NextRuntime.IsZero() {
+		log.Info.Printf("Job %s has no further scheduled runs", job.Name)
 	} else {
 		log.Info.Printf("Job %s next run time %s", job.Name, job.FmtNextRuntime())
 	}
 
-	if err := setNextjob(); err != nil {
-		return err
-	}
-
-	return releaseJobsLock() // Explicit unlock to ensure logging of any error
+	return setNextjob()
 }
 
-// Scan all jobs and save the next to run in /nextjobs.  
+// Scan all jobs and pending ad-hoc runs and save the next to run in /nextjobs, skipping
+// those that no running server can run.
 // The caller must acquire the lock prior to calling this function
 func setNextjob() error {
-	if jobs, _, err := zkConn.Children(PATH_JOBS); err != nil {
+	if jobs, err := store.Children(PATH_JOBS); err != nil {
 		return fmt.Errorf("Unable to get list of jobs to calculate schedule: %s", err.Error())
+	} else if adhocs, err := listAdhoc(); err != nil {
+		return err
+	} else if servers, err := getServers(); err != nil {
+		return err
 	} else {
 		var job *Job
 		for _, jobName := range jobs {
-			if jobData, _, err := zkConn.Get(fmt.Sprintf("%s/%s", PATH_JOBS, jobName)); err != nil {
+			znode := fmt.Sprintf("%s/%s", PATH_JOBS, jobName)
+			if jobData, err := store.Get(znode); err != nil {
 				return err
 			} else if job2, err := Deserialize(jobData); err != nil {
-				return err
-			} else if job == nil || (job.NextRuntime.After(job2.NextRuntime) && !job2.HasError) {
+				if err = quarantine(znode, jobData, err); err != nil {
+					return err
+				}
+			} else if !job2.Runnable() {
+				continue
+			} else if !job2.placeable(servers) {
+				job2.logUnplaceable()
+			} else if job == nil || job.NextRuntime.After(job2.NextRuntime) {
+				job = job2
+			}
+		}
+		for _, job2 := range adhocs {
+			if !job2.placeable(servers) {
+				job2.logUnplaceable()
+			} else if job == nil || job.NextRuntime.After(job2.NextRuntime) {
 				job = job2
 			}
 		}
 		if job == nil {
 			log.Warning.Printf("There are no jobs remaining to schedule")
-			zkConn.Set(PATH_NEXT_JOB, nil, -1)
+			store.Set(PATH_NEXT_JOB, nil)
 		} else if jobData, err := job.Serialize(); err != nil {
 			return err
-		} else if _, err = zkConn.Set(PATH_NEXT_JOB, jobData, -1); err != nil {
+		} else if err = store.Set(PATH_NEXT_JOB, jobData); err != nil {
 			return fmt.Errorf("Unable to update schedule to run next job %s: %s", job.Name, err.Error())
 		}
 	}
 	return nil
 }
 
+// Log that a job isn't being scheduled as no running server can run it, with a warning once it's due
+func (job *Job) logUnplaceable() {
+	logger := log.Trace
+	if !job.NextRuntime.After(time.Now()) {
+		logger = log.Warning
+	}
+	run := ""
+	if job.AdHoc != "" {
+		run = fmt.Sprintf("run %s of ", job.AdHoc)
+	}
+	logger.Printf("Keeping %sjob %s pending as no running server matches its placement constraints", run, job.Name)
+}
+
 // Grab the lock if we don't already have it
 func getJobsLock() error {
 	if !hasLock {
@@ -0,0 +1,197 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a test against a new memory store, resetting the package's state when it ends
+func useMemoryStore(t *testing.T) {
+	useStore(t, NewMemoryStore())
+}
+
+// Run a test against a connected store, resetting the package's state when it ends
+func useStore(t *testing.T, s Store) {
+	if err := InitStore(s); err != nil {
+		t.Fatalf("Unable to initialize store: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		if store != nil {
+			Stop()
+		}
+		hasLock = false
+		serverName = ""
+		nextPurge = time.Time{}
+	})
+}
+
+// Add a job to the schedule
+func addJob(t *testing.T, job *Job) {
+	if err := job.Validate(); err != nil {
+		t.Fatalf("Invalid job %s: %s", job.Name, err.Error())
+	} else if _, err = job.SetNextRuntime(); err != nil {
+		t.Fatalf("Can't schedule job %s: %s", job.Name, err.Error())
+	} else if err = job.WriteToZk(); err != nil {
+		t.Fatalf("Can't add job %s: %s", job.Name, err.Error())
+	}
+}
+
+func TestScheduleMaintenance(t *testing.T) {
+	useMemoryStore(t)
+	later := &Job{Name: "later", Schedule: "0 0 1 1 *", Cmd: "true"}
+	sooner := &Job{Name: "sooner", Schedule: "@hourly", Cmd: "true"}
+	addJob(t, later)
+	addJob(t, sooner)
+	nextjob := func() string {
+		b, err := store.Get(PATH_NEXT_JOB)
+		if err != nil {
+			t.Fatalf("Can't get nextjob: %s", err.Error())
+		}
+		job, _ := Deserialize(b)
+		return job.Name
+	}
+	if name := nextjob(); name != "sooner" {
+		t.Errorf("Next job is %s; expected sooner", name)
+	}
+	if err := sooner.Pause(); err != nil {
+		t.Fatalf("Can't pause job sooner: %s", err.Error())
+	} else if name := nextjob(); name != "later" {
+		t.Errorf("Next job after pause is %s; expected later", name)
+	}
+	if jobs, err := ListJobs("*er"); err != nil || len(jobs) != 2 || !jobs[1].Paused {
+		t.Errorf("Unexpected job list %v: %v", jobs, err)
+	}
+	if err := later.DeleteFromZk(); err != nil {
+		t.Fatalf("Can't delete job later: %s", err.Error())
+	} else if name := nextjob(); name != NULL_JOBNAME {
+		t.Errorf("Next job with only a paused job is %s", name)
+	}
+}
+
+// Check that pausing and resuming a stale copy of a job keeps the changes made to it since
+func TestPauseKeepsCurrentJob(t *testing.T) {
+	useMemoryStore(t)
+	addJob(t, &Job{Name: "stale", Schedule: "@hourly", Cmd: "true"})
+	jobs, err := ListJobs("stale")
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("Can't list job stale: %v", err)
+	}
+	stale := jobs[0]
+	current := *stale
+	current.Attempt = 2
+	current.LastServer = "other"
+	if err = current.UpdateZk(); err != nil {
+		t.Fatalf("Can't update job stale: %s", err.Error())
+	}
+	if err = stale.Pause(); err != nil {
+		t.Fatalf("Can't pause job stale: %s", err.Error())
+	} else if !stale.Paused || stale.Attempt != 2 || stale.LastServer != "other" {
+		t.Errorf("Job stale after pause is %+v; expected the current job, paused", stale)
+	}
+	if jobs, err = ListJobs("stale"); err != nil || len(jobs) != 1 {
+		t.Fatalf("Can't list job stale: %v", err)
+	} else if !jobs[0].Paused || jobs[0].Attempt != 2 || jobs[0].LastServer != "other" {
+		t.Errorf("Stored job stale after pause is %+v; expected the current job, paused", jobs[0])
+	}
+	if err = stale.Resume(); err != nil {
+		t.Errorf("Can't resume job stale: %s", err.Error())
+	} else if err = current.Resume(); err == nil {
+		t.Errorf("Resumed job stale twice")
+	}
+}
+
+func TestServerRunsJob(t *testing.T) {
+	useMemoryStore(t)
+	testServerRunsJob(t)
+}
+
+// Check that a server run against the package's store runs a job and stops when its session closes
+func testServerRunsJob(t *testing.T) {
+	addJob(t, &Job{Name: "hello", At: time.Now().Add(100 * time.Millisecond), Retain: time.Hour, Cmd: "echo", Args: []string{"hello"}})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Run("test", false)
+	}()
+
+	// The server's information is saved last when a run ends, so wait for its run count to return to zero
+	var history []*RunRecord
+	for deadline := time.Now().Add(5 * time.Second); len(history) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Job didn't run")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if servers, err := getServers(); err == nil && servers["test"] != nil && servers["test"].Running == 0 {
+			history, _ = ListHistory("hello", 0)
+		}
+	}
+	if record := history[0]; record.Server != "test" || record.Err != "" {
+		t.Errorf("Unexpected run %+v", record)
+	}
+	if outputs, err := ListOutput("hello", 1); err != nil || len(outputs) != 1 || strings.TrimSpace(string(outputs[0].Output)) != "hello" {
+		t.Errorf("Unexpected output %v: %v", outputs, err)
+	}
+
+	setRunning(false)
+	store.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Server didn't stop when its session closed")
+	}
+}
+
+// Check that a server holding the lock for other work leaves due jobs to the server chosen to run them
+func TestServerLeavesJobs(t *testing.T) {
+	useMemoryStore(t)
+	RegisterPlacement("test-other", namedPlacement("other"))
+	other := addServer(t, "other")
+	for _, name := range []string{"first", "second"} {
+		addJob(t, &Job{Name: name, At: time.Now().Add(50 * time.Millisecond), Retain: time.Hour, Placement: "test-other", Cmd: "true"})
+	}
+	requested := make(chan struct{}, 1)
+	submitLocked(func() { requested <- struct{}{} })
+	time.Sleep(100 * time.Millisecond)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Run("self", false)
+	}()
+
+	// The server takes the lock to handle the request, so it must release it to leave the jobs
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Locked request not handled")
+	}
+	lock := other.NewLock(PATH_JOBLOCK)
+	locked := make(chan error, 1)
+	go func() {
+		locked <- lock.Lock()
+	}()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatalf("Can't get lock: %s", err.Error())
+		}
+	case <-time.After(PLACEMENT_FALLBACK / 2):
+		t.Fatalf("Server kept the lock with jobs due on another server")
+	}
+	for _, name := range []string{"first", "second"} {
+		if jobs, err := ListJobs(name); err != nil || len(jobs) != 1 {
+			t.Errorf("Can't list job %s: %v", name, err)
+		} else if jobs[0].PlacedOn != "" || jobs[0].NextRuntime.IsZero() {
+			t.Errorf("Job %s left to another server ran on %s", name, jobs[0].PlacedOn)
+		} else if exists, _ := store.Exists(claimPath(name)); exists {
+			t.Errorf("Job %s left to another server was claimed", name)
+		}
+	}
+	lock.Unlock()
+
+	setRunning(false)
+	store.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Server didn't stop when its session closed")
+	}
+}
@@ -0,0 +1,209 @@
+package cron
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/tooda02/castle-cron/logging"
+)
+
+var (
+	ServerLabels = map[string]string{} // Labels this server advertises for job placement, set by the -l flag
+)
+
+// Information a server advertises in its znode /servers/<servername>
+type ServerInfo struct {
+	Name    string            // Name of the server
+	Labels  map[string]string // Labels matched by job selectors, e.g. zone=east
+	Started bool              // Server has finished starting
+	Running int               // Number of runs active on the server, used by least-running placement
+}
+
+// Return the information this server advertises
+func localServerInfo(started bool) *ServerInfo {
+	return &ServerInfo{Name: serverName, Labels: ServerLabels, Started: started, Running: int(atomic.LoadInt32(&runningCount))}
+}
+
+// Save this server's information in /servers/<servername>
+func (info *ServerInfo) save() error {
+	if b, err := gobEncode(info); err != nil {
+		return fmt.Errorf("Unable to serialize information of server %s: %s", info.Name, err.Error())
+	} else if err = store.Set(fmt.Sprintf("%s/%s", PATH_SERVERS, info.Name), b); err != nil {
+		return fmt.Errorf("Unable to update information of server %s: %s", info.Name, err.Error())
+	}
+	return nil
+}
+
+// Get the information of all running servers, by name.  A server whose information
+// can't be decoded, such as one from an earlier release, has no labels.
+func getServers() (servers map[string]*ServerInfo, e error) {
+	names, err := store.Children(PATH_SERVERS)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list servers: %s", err.Error())
+	}
+	servers = map[string]*ServerInfo{}
+	for _, name := range names {
+		info := &ServerInfo{}
+		if b, err := store.Get(fmt.Sprintf("%s/%s", PATH_SERVERS, name)); err != nil {
+			continue // Server stopped since we listed the servers
+		} else if err = gobDecode(b, info); err != nil {
+			log.Trace.Printf("Server %s has no server information: %s", name, err.Error())
+			info = &ServerInfo{}
+		}
+		info.Name = name
+		servers[name] = info
+	}
+	return
+}
+
+// Get the information of all running servers, sorted by name
+func ListServers() ([]*ServerInfo, error) {
+	servers, err := getServers()
+	if err != nil {
+		return nil, err
+	}
+	list := []*ServerInfo{}
+	for _, info := range servers {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Parse a list of labels of the form name=value,name=value
+func ParseLabels(list string) (labels map[string]string, e error) {
+	labels = map[string]string{}
+	for _, label := range strings.Split(list, ",") {
+		if label = strings.TrimSpace(label); label == "" {
+			continue
+		} else if i := strings.Index(label, "="); i < 1 || !validLabelName(label[:i]) {
+			return nil, fmt.Errorf("Invalid server label \"%s\"; must be name=value", label)
+		} else {
+			labels[label[:i]] = label[i+1:]
+		}
+	}
+	return
+}
+
+// Format labels as name=value,name=value
+func FormatLabels(labels map[string]string) string {
+	list := []string{}
+	for name, value := range labels {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+/*
+Check whether server labels match a job selector, a comma-separated list of
+requirements that must all be met:
+
+	name=value    The server has label name with this value
+	name!=value   The server doesn't have label name with this value
+	name          The server has label name
+	!name         The server doesn't have label name
+
+An empty selector matches every server.
+*/
+func matchSelector(selector string, labels map[string]string) (bool, error) {
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		name, value, op := term, "", ""
+		if i := strings.Index(term, "!="); i >= 0 {
+			name, value, op = term[:i], term[i+2:], "!="
+		} else if i := strings.Index(term, "="); i >= 0 {
+			name, value, op = term[:i], term[i+1:], "="
+		} else if strings.HasPrefix(term, "!") {
+			name, op = term[1:], "!"
+		}
+		if !validLabelName(name) {
+			return false, fmt.Errorf("Invalid selector requirement \"%s\"", term)
+		}
+		found, ok := labels[name]
+		switch op {
+		case "=":
+			ok = ok && found == value
+		case "!=":
+			ok = !ok || found != value
+		case "!":
+			ok = !ok
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Check that a label name is valid
+func validLabelName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "=!, ")
+}
+
+// Check whether a server name matches any of a list of patterns, e.g. db1-*
+func matchServerName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); ok && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that a job's server name patterns are well formed
+func (job *Job) validateServers() error {
+	for _, pattern := range job.Servers {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("Invalid server name pattern \"%s\" for job %s", pattern, job.Name)
+		}
+	}
+	return nil
+}
+
+// Check whether a job can run on a server
+func (job *Job) placeableOn(info *ServerInfo) bool {
+	if len(job.Servers) > 0 && !matchServerName(job.Servers, info.Name) {
+		return false
+	}
+	ok, err := matchSelector(job.Selector, info.Labels)
+	return ok && err == nil
+}
+
+// Check whether a job can run on any of a set of servers.  A job without placement constraints
+// is placeable even if no server is running, as the first server to start can run it.
+func (job *Job) placeable(servers map[string]*ServerInfo) bool {
+	if job.Selector == "" && len(job.Servers) == 0 {
+		return true
+	}
+	for _, info := range servers {
+		if job.placeableOn(info) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a job can run on any of a list of servers returned by ListServers()
+func (job *Job) PlaceableAmong(servers []*ServerInfo) bool {
+	serverMap := map[string]*ServerInfo{}
+	for _, info := range servers {
+		serverMap[info.Name] = info
+	}
+	return job.placeable(serverMap)
+}
+
+// Check whether any running server can run a job
+func (job *Job) Placeable() (bool, error) {
+	if servers, err := getServers(); err != nil {
+		return false, err
+	} else {
+		return job.placeable(servers), nil
+	}
+}
@@ -0,0 +1,191 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchSelector(t *testing.T) {
+	labels := map[string]string{"zone": "east", "role": "db"}
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{"", true},
+		{"zone=east", true},
+		{"zone=west", false},
+		{"zone=east,role=db", true},
+		{"zone=east,role=web", false},
+		{"role!=web", true},
+		{"role!=db", false},
+		{"gpu!=yes", true},
+		{"role", true},
+		{"gpu", false},
+		{"!gpu", true},
+		{"!role", false},
+	}
+	for _, test := range tests {
+		if match, err := matchSelector(test.selector, labels); err != nil {
+			t.Errorf("Selector %s: %s", test.selector, err.Error())
+		} else if match != test.match {
+			t.Errorf("Selector %s: match %v; expected %v", test.selector, match, test.match)
+		}
+	}
+	for _, selector := range []string{"=east", "!=db", "!"} {
+		if _, err := matchSelector(selector, labels); err == nil {
+			t.Errorf("Selector %s: expected error", selector)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	if labels, err := ParseLabels("zone=east, role=db"); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	} else if got := FormatLabels(labels); got != "role=db,zone=east" {
+		t.Errorf("Labels are %s", got)
+	}
+	if _, err := ParseLabels("zone"); err == nil {
+		t.Errorf("Expected error for label without value")
+	}
+}
+
+func TestPlaceable(t *testing.T) {
+	servers := map[string]*ServerInfo{
+		"db1-100": {Name: "db1-100", Labels: map[string]string{"role": "db"}},
+		"web1":    {Name: "web1", Labels: map[string]string{"role": "web"}},
+	}
+	tests := []struct {
+		job       Job
+		placeable bool
+	}{
+		{Job{Name: "anywhere"}, true},
+		{Job{Name: "pinned", Servers: []string{"web1"}}, true},
+		{Job{Name: "wildcard", Servers: []string{"db?-*"}}, true},
+		{Job{Name: "missing", Servers: []string{"db2-*"}}, false},
+		{Job{Name: "both", Servers: []string{"db*"}, Selector: "role=db"}, true},
+		{Job{Name: "conflict", Servers: []string{"web1"}, Selector: "role=db"}, false},
+	}
+	for _, test := range tests {
+		if got := test.job.placeable(servers); got != test.placeable {
+			t.Errorf("Job %s: placeable %v; expected %v", test.job.Name, got, test.placeable)
+		}
+	}
+	if got := (&Job{Name: "pinned", Servers: []string{"web1"}}).placeable(nil); got {
+		t.Errorf("Job pinned: placeable with no servers running")
+	}
+}
+
+func TestChoosePlacement(t *testing.T) {
+	servers := map[string]*ServerInfo{
+		"a": {Name: "a", Started: true, Running: 2},
+		"b": {Name: "b", Started: true, Running: 0},
+		"c": {Name: "c", Started: true, Running: 1},
+		"d": {Name: "d", Started: false},
+	}
+	tests := []struct {
+		job    Job
+		chosen string
+	}{
+		{Job{Name: "rr", Placement: PLACEMENT_ROUND_ROBIN}, "a"},
+		{Job{Name: "rr", Placement: PLACEMENT_ROUND_ROBIN, PlacedOn: "a"}, "b"},
+		{Job{Name: "rr", Placement: PLACEMENT_ROUND_ROBIN, PlacedOn: "c"}, "a"},
+		{Job{Name: "least", Placement: PLACEMENT_LEAST_RUNNING}, "b"},
+		{Job{Name: "retry", Placement: PLACEMENT_LEAST_RUNNING, Attempt: 1, LastServer: "b"}, "c"},
+		{Job{Name: "pinned", Placement: PLACEMENT_LEAST_RUNNING, Servers: []string{"a", "d"}}, "a"},
+		{Job{Name: "race", Placement: PLACEMENT_RACE}, ""},
+	}
+	for _, test := range tests {
+		if got := test.job.choosePlacement(servers); got != test.chosen {
+			t.Errorf("Job %s: chose %s; expected %s", test.job.Name, got, test.chosen)
+		}
+	}
+	job := &Job{Name: "random", Placement: PLACEMENT_RANDOM, NextRuntime: time.Now()}
+	if first := job.choosePlacement(servers); first == "" || first == "d" {
+		t.Errorf("Job random: chose %s", first)
+	} else if again := job.choosePlacement(servers); again != first {
+		t.Errorf("Job random: chose %s then %s for the same run", first, again)
+	}
+}
+
+// Choose the candidate with a given name, as the placement strategy of test jobs
+type namedPlacement string
+
+func (name namedPlacement) Choose(job *Job, candidates []*ServerInfo) *ServerInfo {
+	for _, info := range candidates {
+		if info.Name == string(name) {
+			return info
+		}
+	}
+	return nil
+}
+
+// Add a started server with its own session, which is closed when the test ends
+func addServer(t *testing.T, name string) *MemoryStore {
+	session := store.(*MemoryStore).NewSession()
+	t.Cleanup(session.Close)
+	if b, err := gobEncode(&ServerInfo{Name: name, Started: true}); err != nil {
+		t.Fatalf("Can't serialize server %s: %s", name, err.Error())
+	} else if err = session.Create(PATH_SERVERS+"/"+name, b, true); err != nil {
+		t.Fatalf("Can't add server %s: %s", name, err.Error())
+	}
+	return session
+}
+
+func TestClaimRun(t *testing.T) {
+	useMemoryStore(t)
+	RegisterPlacement("test-self", namedPlacement("self"))
+	RegisterPlacement("test-other", namedPlacement("other"))
+	addServer(t, "self")
+	other := addServer(t, "other")
+	serverName = "self"
+	now := time.Now()
+	claimant := func(name string) string {
+		claim := &runClaim{}
+		if b, err := store.Get(claimPath(name)); err != nil {
+			return ""
+		} else if err = gobDecode(b, claim); err != nil {
+			t.Fatalf("Can't decode claim of job %s: %s", name, err.Error())
+		}
+		return claim.Server
+	}
+
+	// The chosen server claims the run at once, replacing a claim to an earlier run
+	mine := &Job{Name: "mine", Placement: "test-self", NextRuntime: now}
+	stale, _ := gobEncode(&runClaim{Server: "other", Run: "mine//0"})
+	if err := other.Create(claimPath("mine"), stale, true); err != nil {
+		t.Fatalf("Can't add stale claim: %s", err.Error())
+	}
+	if claimed, _, _, err := mine.claimRun(now); err != nil || !claimed || claimant("mine") != "self" {
+		t.Errorf("Job mine: claimed %v by %s; expected claim by self (%v)", claimed, claimant("mine"), err)
+	}
+	mine.dropClaim()
+	if server := claimant("mine"); server != "" {
+		t.Errorf("Job mine: claim by %s not dropped", server)
+	}
+
+	// Other servers leave the run to the chosen server until the fallback, and then contend for it
+	theirs := &Job{Name: "theirs", Placement: "test-other", NextRuntime: now}
+	if claimed, wait, watch, err := theirs.claimRun(now); err != nil || claimed || wait != PLACEMENT_FALLBACK || watch == nil {
+		t.Errorf("Job theirs: claimed %v, wait %v; expected to wait %v (%v)", claimed, wait, PLACEMENT_FALLBACK, err)
+	}
+	if claimed, _, _, err := theirs.claimRun(now.Add(PLACEMENT_FALLBACK)); err != nil || !claimed {
+		t.Errorf("Job theirs: not claimed after fallback (%v)", err)
+	}
+	theirs.dropClaim()
+
+	// Once the chosen server claims the run, the others wait for as long as the claim stands
+	b, _ := gobEncode(&runClaim{Server: "other", Run: theirs.runKey()})
+	if err := other.Create(claimPath("theirs"), b, true); err != nil {
+		t.Fatalf("Can't add claim: %s", err.Error())
+	}
+	claimed, wait, watch, err := theirs.claimRun(now.Add(time.Hour))
+	if err != nil || claimed || wait != 0 || watch == nil {
+		t.Fatalf("Job theirs: claimed %v, wait %v; expected to wait for the claim (%v)", claimed, wait, err)
+	}
+	other.Close()
+	select {
+	case <-watch:
+	case <-time.After(time.Second):
+		t.Errorf("Job theirs: claim watch didn't fire when its server stopped")
+	}
+}
@@ -0,0 +1,108 @@
+package cron
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+A Store is the coordination service that holds the schedule and lets servers
+and the CLI cooperate.  It's a tree of nodes addressed by slash-separated paths,
+modelled on Zookeeper: a node can only be created under an existing parent and
+only deleted once it has no children, an ephemeral node is deleted when the
+session that created it ends, and a watch fires once, on the next change to
+the node it was set on.
+*/
+type Store interface {
+	// Get the data of a node
+	Get(path string) ([]byte, error)
+
+	// Get the data of a node and set a watch that fires when it's changed or deleted
+	GetW(path string) ([]byte, <-chan Event, error)
+
+	// Replace the data of an existing node
+	Set(path string, data []byte) error
+
+	// Create a node, which is deleted when this session ends if it's ephemeral
+	Create(path string, data []byte, ephemeral bool) error
+
+	// Delete a node that has no children
+	Delete(path string) error
+
+	// Check whether a node exists
+	Exists(path string) (bool, error)
+
+	// Check whether a node exists and set a watch that fires when it's created, changed, or deleted
+	ExistsW(path string) (bool, <-chan Event, error)
+
+	// Get the names of the children of a node
+	Children(path string) ([]string, error)
+
+	// Get the names of the children of a node and set a watch that fires when one is added or deleted
+	ChildrenW(path string) ([]string, <-chan Event, error)
+
+	// Return a lock, shared by every session, identified by a node
+	NewLock(path string) Locker
+
+	// End the session, deleting its ephemeral nodes and firing its watches with ErrClosed
+	Close()
+}
+
+// A lock shared by every session of a Store
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// Types of change reported by a watch
+const (
+	EVENT_CREATED          = "created"          // The node was created
+	EVENT_DELETED          = "deleted"          // The node was deleted
+	EVENT_DATA_CHANGED     = "data-changed"     // The data of the node was replaced
+	EVENT_CHILDREN_CHANGED = "children-changed" // A child of the node was created or deleted
+	EVENT_SESSION          = "session"          // The session ended or failed, as reported in Err
+)
+
+// A change reported by a watch
+type Event struct {
+	Type string // Type of change
+	Path string // Path of the node watched
+	Err  error  // Error ending the watch, if any
+}
+
+// Errors returned by every Store, so callers can check for them whatever the implementation
+var (
+	ErrNoNode     = errors.New("node does not exist")
+	ErrNodeExists = errors.New("node already exists")
+	ErrNotEmpty   = errors.New("node has children")
+	ErrClosed     = errors.New("store session closed")
+)
+
+// Prefixes of a store address that select a store other than Zookeeper
+const (
+	ETCD_SCHEME   = "etcd://" // etcd v3 cluster
+	FILE_SCHEME   = "file://" // Directory on local disk
+	MEMORY_SCHEME = "mem://"  // Memory of this process, for a server running alone
+)
+
+/*
+Connect to the store at an address with a session timeout in seconds.  An
+address of the form etcd://host:port[,host:port...] selects an etcd v3 cluster,
+one of the form file://dir selects a file store in a local directory, and
+mem:// selects a memory store that lasts as long as this process; any other
+address is a comma-separated list of Zookeeper servers.
+*/
+func ConnectStore(address string, timeout int) (Store, error) {
+	if strings.HasPrefix(address, ETCD_SCHEME) {
+		return ConnectEtcd(strings.TrimPrefix(address, ETCD_SCHEME), timeout)
+	} else if address == MEMORY_SCHEME {
+		return NewMemoryStore(), nil
+	} else if strings.HasPrefix(address, FILE_SCHEME) {
+		if s, err := OpenFileStore(strings.TrimPrefix(address, FILE_SCHEME)); err != nil {
+			return nil, err
+		} else {
+			return s, nil
+		}
+	}
+	return ConnectZookeeper(address, timeout)
+}
@@ -0,0 +1,155 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+// Wait briefly for a watch to fire
+func waitEvent(t *testing.T, watch <-chan Event) Event {
+	select {
+	case evt := <-watch:
+		return evt
+	case <-time.After(time.Second):
+		t.Fatalf("Watch didn't fire")
+	}
+	return Event{}
+}
+
+// Check that a store creates, lists, updates, and deletes nodes like Zookeeper
+func testStoreNodes(t *testing.T, s Store) {
+	if err := s.Create("/a/b", nil, false); err != ErrNoNode {
+		t.Errorf("Create without parent: %v; expected %v", err, ErrNoNode)
+	}
+	if err := s.Create("/a", []byte("1"), false); err != nil {
+		t.Fatalf("Create /a: %s", err.Error())
+	} else if err = s.Create("/a", nil, false); err != ErrNodeExists {
+		t.Errorf("Create existing: %v; expected %v", err, ErrNodeExists)
+	} else if err = s.Create("/a/c", nil, false); err != nil {
+		t.Errorf("Create /a/c: %s", err.Error())
+	} else if err = s.Create("/a/b", nil, false); err != nil {
+		t.Errorf("Create /a/b: %s", err.Error())
+	}
+	if children, err := s.Children("/a"); err != nil || len(children) != 2 || children[0] != "b" || children[1] != "c" {
+		t.Errorf("Children of /a: %v %v", children, err)
+	}
+	if err := s.Delete("/a"); err != ErrNotEmpty {
+		t.Errorf("Delete with children: %v; expected %v", err, ErrNotEmpty)
+	}
+	if err := s.Set("/a", []byte("2")); err != nil {
+		t.Errorf("Set /a: %s", err.Error())
+	} else if b, err := s.Get("/a"); err != nil || string(b) != "2" {
+		t.Errorf("Get /a: %s %v", b, err)
+	}
+	if err := s.Set("/x", nil); err != ErrNoNode {
+		t.Errorf("Set missing: %v; expected %v", err, ErrNoNode)
+	}
+}
+
+// Check that a store's watches fire once on the changes they watch for
+func testStoreWatches(t *testing.T, s Store) {
+	s.Create("/a", nil, false)
+	_, dataWatch, _ := s.GetW("/a")
+	_, childWatch, _ := s.ChildrenW("/a")
+	exists, createWatch, _ := s.ExistsW("/a/b")
+	if exists {
+		t.Errorf("/a/b exists before it's created")
+	}
+	s.Create("/a/b", nil, false)
+	if evt := waitEvent(t, createWatch); evt.Type != EVENT_CREATED {
+		t.Errorf("Exists watch fired with %s; expected %s", evt.Type, EVENT_CREATED)
+	}
+	if evt := waitEvent(t, childWatch); evt.Type != EVENT_CHILDREN_CHANGED {
+		t.Errorf("Children watch fired with %s; expected %s", evt.Type, EVENT_CHILDREN_CHANGED)
+	}
+	select {
+	case evt := <-dataWatch:
+		t.Errorf("Data watch fired by a new child: %+v", evt)
+	default:
+	}
+	s.Set("/a", []byte("x"))
+	if evt := waitEvent(t, dataWatch); evt.Type != EVENT_DATA_CHANGED {
+		t.Errorf("Data watch fired with %s; expected %s", evt.Type, EVENT_DATA_CHANGED)
+	}
+}
+
+// Check that closing a store session ends its watches and ephemeral nodes, and that sessions share locks
+func testStoreSessions(t *testing.T, s Store, newSession func() Store) {
+	other := newSession()
+	s.Create("/servers", nil, false)
+	other.Create("/servers/other", nil, true)
+	_, watch, _ := s.ChildrenW("/servers")
+	_, closing, _ := other.GetW("/servers")
+	other.Close()
+	if evt := waitEvent(t, closing); evt.Err != ErrClosed {
+		t.Errorf("Watch of closed session fired with %v; expected %v", evt.Err, ErrClosed)
+	}
+	waitEvent(t, watch)
+	if children, _ := s.Children("/servers"); len(children) != 0 {
+		t.Errorf("Ephemeral nodes of closed session remain: %v", children)
+	}
+	if _, err := other.Get("/servers"); err != ErrClosed {
+		t.Errorf("Get after close: %v; expected %v", err, ErrClosed)
+	}
+
+	lock := s.NewLock("/lock")
+	lock.Lock()
+	locked := make(chan struct{})
+	go func() {
+		newSession().NewLock("/lock").Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Lock taken by two sessions")
+	case <-time.After(50 * time.Millisecond):
+	}
+	lock.Unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("Lock not granted after unlock")
+	}
+}
+
+func TestMemoryStoreNodes(t *testing.T) {
+	testStoreNodes(t, NewMemoryStore())
+}
+
+func TestMemoryStoreWatches(t *testing.T) {
+	testStoreWatches(t, NewMemoryStore())
+}
+
+func TestMemoryStoreSessions(t *testing.T) {
+	s := NewMemoryStore()
+	testStoreSessions(t, s, func() Store { return s.NewSession() })
+}
+
+func TestMemoryStoreLockOwner(t *testing.T) {
+	s := NewMemoryStore()
+	holder, other := s.NewSession(), s.NewSession()
+	lock := holder.NewLock("/lock")
+	if err := lock.Lock(); err != nil {
+		t.Fatalf("Can't take lock: %s", err.Error())
+	} else if err = other.NewLock("/lock").Unlock(); err == nil {
+		t.Errorf("Lock released by a session that doesn't hold it")
+	}
+
+	// Closing the session holding the lock releases it
+	locked := make(chan struct{})
+	go func() {
+		other.NewLock("/lock").Lock()
+		close(locked)
+	}()
+	holder.Close()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("Lock of closed session not released")
+	}
+	if err := lock.Unlock(); err == nil {
+		t.Errorf("Closed session released a lock it no longer holds")
+	} else if err = lock.Lock(); err != ErrClosed {
+		t.Errorf("Closed session took lock: %v", err)
+	}
+}
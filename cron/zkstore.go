@@ -0,0 +1,126 @@
+package cron
+
+import (
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// A Store backed by a Zookeeper ensemble
+type zkStore struct {
+	conn *zk.Conn
+}
+
+// Connect to a comma-separated list of Zookeeper servers with a session timeout in seconds
+func ConnectZookeeper(server string, timeout int) (Store, error) {
+	conn, _, err := zk.Connect(strings.Split(server, ","), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &zkStore{conn: conn}, nil
+}
+
+// Translate a Zookeeper error into the corresponding Store error
+func zkError(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrNoNode
+	case zk.ErrNodeExists:
+		return ErrNodeExists
+	case zk.ErrNotEmpty:
+		return ErrNotEmpty
+	case zk.ErrClosing, zk.ErrConnectionClosed:
+		return ErrClosed
+	}
+	return err
+}
+
+// Translate the first event from a Zookeeper watch into a Store event
+func zkWatch(watch <-chan zk.Event) <-chan Event {
+	events := make(chan Event, 1)
+	go func() {
+		evt := <-watch
+		event := Event{Path: evt.Path, Err: zkError(evt.Err)}
+		switch evt.Type {
+		case zk.EventNodeCreated:
+			event.Type = EVENT_CREATED
+		case zk.EventNodeDeleted:
+			event.Type = EVENT_DELETED
+		case zk.EventNodeDataChanged:
+			event.Type = EVENT_DATA_CHANGED
+		case zk.EventNodeChildrenChanged:
+			event.Type = EVENT_CHILDREN_CHANGED
+		default:
+			event.Type = EVENT_SESSION
+		}
+		events <- event
+	}()
+	return events
+}
+
+func (s *zkStore) Get(path string) ([]byte, error) {
+	b, _, err := s.conn.Get(path)
+	return b, zkError(err)
+}
+
+func (s *zkStore) GetW(path string) ([]byte, <-chan Event, error) {
+	b, _, watch, err := s.conn.GetW(path)
+	if err != nil {
+		return nil, nil, zkError(err)
+	}
+	return b, zkWatch(watch), nil
+}
+
+func (s *zkStore) Set(path string, data []byte) error {
+	_, err := s.conn.Set(path, data, -1)
+	return zkError(err)
+}
+
+func (s *zkStore) Create(path string, data []byte, ephemeral bool) error {
+	var flags int32
+	if ephemeral {
+		flags = zk.FlagEphemeral
+	}
+	_, err := s.conn.Create(path, data, flags, zk.WorldACL(zk.PermAll))
+	return zkError(err)
+}
+
+func (s *zkStore) Delete(path string) error {
+	return zkError(s.conn.Delete(path, -1))
+}
+
+func (s *zkStore) Exists(path string) (bool, error) {
+	exists, _, err := s.conn.Exists(path)
+	return exists, zkError(err)
+}
+
+func (s *zkStore) ExistsW(path string) (bool, <-chan Event, error) {
+	exists, _, watch, err := s.conn.ExistsW(path)
+	if err != nil {
+		return false, nil, zkError(err)
+	}
+	return exists, zkWatch(watch), nil
+}
+
+func (s *zkStore) Children(path string) ([]string, error) {
+	children, _, err := s.conn.Children(path)
+	return children, zkError(err)
+}
+
+func (s *zkStore) ChildrenW(path string) ([]string, <-chan Event, error) {
+	children, _, watch, err := s.conn.ChildrenW(path)
+	if err != nil {
+		return nil, nil, zkError(err)
+	}
+	return children, zkWatch(watch), nil
+}
+
+// Return a lock implemented by Zookeeper's lock recipe, with sequential ephemeral children of the node
+func (s *zkStore) NewLock(path string) Locker {
+	return zk.NewLock(s.conn, path, zk.WorldACL(zk.PermAll))
+}
+
+func (s *zkStore) Close() {
+	s.conn.Close()
+}
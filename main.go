@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/tooda02/castle-cron/cli"
 	"github.com/tooda02/castle-cron/cron"
@@ -23,6 +24,8 @@ var (
 	force     *bool                // true => force setup even if server already active
 	help      *bool                // true => print usage and exit
 	name      string               // name of server
+	labels    string               // labels of server, e.g. zone=east,role=db
+	storeAddr string               // Store address, e.g. etcd://host:port, file://dir, or mem://; overrides zkServer
 	zkServer  string               // Zookeeper server
 	zkTimeout = DEFAULT_ZK_TIMEOUT // Zookeeper session timeout
 )
@@ -30,16 +33,23 @@ var (
 func init() {
 	force = flag.Bool("f", false, "Force running server even if server of that name is already active")
 	help = flag.Bool("h", false, "Print help and exit")
+	flag.DurationVar(&cron.HistoryMaxAge, "ha", 0, "Maximum age of run history kept per job when -s specified (e.g. 720h); 0 => no limit")
+	flag.DurationVar(&cron.KillGracePeriod, "kg", cron.DEFAULT_KILL_GRACE, "Wait between SIGTERM and SIGKILL for a job that exceeds its timeout when -s specified")
+	flag.IntVar(&cron.HistoryRunsKept, "hn", cron.DEFAULT_HISTORY_RUNS, "Number of runs of history kept per job when -s specified; 0 => no limit")
+	flag.StringVar(&labels, "l", "", "Labels matched by job selectors when -s specified, e.g. zone=east,role=db")
 	flag.StringVar(&name, "n", "", "Name of server when -s specified (default %h); %h->hostname; %p->pid")
+	flag.IntVar(&cron.MaxOutputSize, "om", cron.DEFAULT_MAX_OUTPUT, "Maximum bytes of job output saved per run when -s specified")
+	flag.IntVar(&cron.OutputRunsKept, "or", cron.DEFAULT_OUTPUT_RUNS, "Number of runs of job output saved per job when -s specified")
 	isServer = flag.Bool("s", false, "Run as a castle-cron server daemon")
+	flag.StringVar(&storeAddr, "store", "", "Store holding the schedule in form etcd://host:port[,host:port...], file://dir, or mem:// (with -s only); overrides -zk")
 	verbose = flag.Bool("v", false, "Provide TRACE logging")
 	flag.StringVar(&zkServer, "zk", "ZOOKEEPER_SERVERS", "Comma-separated list of Zookeeper server(s) in form host:port")
-	flag.IntVar(&zkTimeout, "zt", DEFAULT_ZK_TIMEOUT, "Zookeeper session timeout in seconds")
+	flag.IntVar(&zkTimeout, "zt", DEFAULT_ZK_TIMEOUT, "Zookeeper session timeout, or etcd lease time-to-live, in seconds")
 }
 
 func usage(rc int) {
-	fmt.Printf("Usage: castle-cron [-d] [-f] [-s] [-n name] [-zk server:port] [-zt timeout]\n")
-	fmt.Printf("       castle-cron add|upd|del|list jobname \"schedule\" cmd args...\n\n")
+	fmt.Printf("Usage: castle-cron [-d] [-f] [-s] [-n name] [-l labels] [-ha age] [-hn runs] [-kg grace] [-om bytes] [-or runs] [-store etcd://host:port|file://dir|mem://] [-zk server:port] [-zt timeout]\n")
+	fmt.Printf("       castle-cron add|upd|del|list|pause|resume|run|servers|output|history|migrate|doctor jobname \"schedule\" cmd args...\n\n")
 	fmt.Printf("Run a castle-cron job scheduler server and/or maintain its job queue.\n")
 	fmt.Printf("The second form of the command maintains the job queue.  Use castle-cron help <cmd> for help on its subcommands.\n\n")
 	flag.PrintDefaults()
@@ -53,33 +63,46 @@ func main() {
 	}
 	log.SetDebug(*verbose)
 	overrideFromEnv(&zkServer, "ZOOKEEPER_SERVERS")
-	log.Trace.Printf("s(%t) zk(%s) zt(%d)", isServer, zkServer, zkTimeout)
-	if zkServer == "" {
+	log.Trace.Printf("s(%t) store(%s) zk(%s) zt(%d)", *isServer, storeAddr, zkServer, zkTimeout)
+	if storeAddr == "" {
+		storeAddr = zkServer
+	} else if storeAddr == cron.MEMORY_SCHEME && !*isServer {
+		log.Error.Printf("-store %s holds the schedule only while a server runs, so it requires -s", storeAddr)
+		usage(2)
+	} else if !strings.HasPrefix(storeAddr, cron.ETCD_SCHEME) && !strings.HasPrefix(storeAddr, cron.FILE_SCHEME) && storeAddr != cron.MEMORY_SCHEME {
+		log.Error.Printf("Invalid -store argument %s; expected %shost:port, %sdir, or %s", storeAddr, cron.ETCD_SCHEME, cron.FILE_SCHEME, cron.MEMORY_SCHEME)
+		usage(2)
+	}
+	if storeAddr == "" {
 		log.Error.Printf("Required Zookeeper server not provided")
 		usage(2)
 	}
 
-	// Connect to Zookeeper and initialize for this run
+	// Connect to the store and initialize for this run
 
-	if err := cron.Init(zkServer, zkTimeout); err != nil {
-		log.Error.Fatalf("Unable to connect to Zookeeper: %s", err.Error())
+	if err := cron.Init(storeAddr, zkTimeout); err != nil {
+		log.Error.Fatalf("Unable to connect to %s: %s", storeAddr, err.Error())
 	} else {
 		defer cron.Stop()
-		log.Trace.Printf("Connected to Zookeeper server %s with session timeout %d seconds", zkServer, zkTimeout)
+		log.Trace.Printf("Connected to %s with session timeout %d seconds", storeAddr, zkTimeout)
 	}
 
 	// If non-flag arguments were specified, execute the CLI command
 
 	if flag.NArg() > 0 {
 		if err := cli.RunCommand(flag.Args()); err != nil {
-			log.Error.Printf(err.Error())
+			log.Error.Println(err.Error())
 			os.Exit(1)
 		}
 	}
 
 	// If -s was specified, run a castle-cron server
 	if *isServer {
-		if err := cron.Run(name, *force); err != nil {
+		var err error
+		if cron.ServerLabels, err = cron.ParseLabels(labels); err != nil {
+			log.Error.Fatalf("Invalid -l argument: %s", err.Error())
+		}
+		if err = cron.Run(name, *force); err != nil {
 			log.Error.Printf("Server terminated with error: %s", err.Error())
 		} else {
 			log.Info.Printf("Server terminated normally")